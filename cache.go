@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	singularity "github.com/opentable/go-singularity"
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+type requestCache struct {
+	URL       string
+	FetchedAt time.Time
+	Requests  dtos.SingularityRequestParentList
+}
+
+// requestCachePath is where the request list of the Singularity at url is
+// cached: in the user's own cache directory, where no one else can plant a
+// request list for cygnus to trust.
+func requestCachePath(url string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cygnus", fmt.Sprintf("requests-%x.cache", sha256.Sum256([]byte(url)))), nil
+}
+
+// getRequests returns the request list for the Singularity at url,
+// reusing a cached copy younger than ttl. A zero ttl always fetches.
+func getRequests(client *singularity.Client, url string, ttl time.Duration) (dtos.SingularityRequestParentList, error) {
+	if ttl <= 0 {
+		return client.GetRequests()
+	}
+
+	path, err := requestCachePath(url)
+	if err != nil {
+		debug("No request cache: %v", err)
+		return client.GetRequests()
+	}
+	if cached, err := readRequestCache(path); err != nil {
+		debug("No usable request cache at %q: %v", path, err)
+	} else if cached.URL == url && nowFunc().Sub(cached.FetchedAt) < ttl {
+		debug("Using cached request list from %s", cached.FetchedAt)
+		return cached.Requests, nil
+	} else {
+		debug("Request cache at %q is stale (fetched %s)", path, cached.FetchedAt)
+	}
+
+	reqList, err := client.GetRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRequestCache(path, &requestCache{URL: url, FetchedAt: nowFunc(), Requests: reqList}); err != nil {
+		debug("Couldn't write request cache %q: %v", path, err)
+	}
+	return reqList, nil
+}
+
+func readRequestCache(path string) (*requestCache, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cached := &requestCache{}
+	if err := gob.NewDecoder(f).Decode(cached); err != nil {
+		return nil, err
+	}
+	return cached, nil
+}
+
+// writeRequestCache replaces the cache at path, readable by its owner alone.
+func writeRequestCache(path string, cached *requestCache) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if err := gob.NewEncoder(f).Encode(cached); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	singularity "github.com/opentable/go-singularity"
+	"github.com/opentable/swaggering"
+)
+
+const (
+	maxThrottleRetries = 5
+	maxRetryAfter      = time.Minute
+)
+
+const unixScheme = "unix://"
+
+// apiCalls counts the HTTP requests made to Singularity, for --timing.
+var apiCalls int64
+
+// newClient builds a client for the Singularity at url. Its transport honors
+// the standard proxy environment variables (HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY, or their lowercase forms) unless opts.proxy overrides them, and
+// backs off when Singularity answers 429 Too Many Requests or takes longer
+// than --request-timeout. It keeps up to
+// --http-max-idle-conns connections open for reuse by the concurrent task
+// fetches.
+//
+// A url like unix:///path/to.sock reaches Singularity through that socket,
+// bypassing any proxy.
+func newClient(opts *options, url string) (*singularity.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConnsPerHost = opts.httpMaxIdleConns
+	if transport.MaxIdleConns < opts.httpMaxIdleConns {
+		transport.MaxIdleConns = opts.httpMaxIdleConns
+	}
+	if opts.httpKeepalive > 0 {
+		transport.IdleConnTimeout = opts.httpKeepalive
+	}
+	baseURL := url
+
+	if strings.HasPrefix(url, unixScheme) {
+		socket := strings.TrimPrefix(url, unixScheme)
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		baseURL = "http://unix"
+	} else if opts.proxy != "" {
+		proxyURL, err := neturl.Parse(opts.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --proxy %q: %v", opts.proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	var base http.RoundTripper = transport
+	if user := clientAuth(opts, url); user != nil {
+		debug("Authenticating to %s as %q", url, user.Username())
+		base = &basicAuthTransport{base: transport, user: user, host: authHost(baseURL)}
+	}
+
+	rt := &retryTransport{base: base, maxRetries: maxThrottleRetries, timeout: opts.requestTimeout}
+	if opts.maxRate > 0 {
+		rt.limiter = newRateLimiter(opts.maxRate)
+	}
+
+	return &singularity.Client{
+		Requester: &swaggering.GenericClient{
+			BaseURL: baseURL,
+			Logger:  swaggering.NullLogger{},
+			HTTP: http.Client{
+				Transport:     rt,
+				CheckRedirect: checkRedirect(opts.maxRedirects),
+			},
+		},
+	}, nil
+}
+
+// clientAuth is the basic auth credentials for the Singularity at url: those
+// given in the URL itself, or else --basic-auth.
+func clientAuth(opts *options, url string) *neturl.Userinfo {
+	if user, ok := opts.urlAuth[url]; ok {
+		return user
+	}
+	if opts.basicAuth == "" {
+		return nil
+	}
+	name, pass := opts.basicAuth, ""
+	if i := strings.Index(opts.basicAuth, ":"); i >= 0 {
+		name, pass = opts.basicAuth[:i], opts.basicAuth[i+1:]
+	}
+	return neturl.UserPassword(name, pass)
+}
+
+// authHost is the host of the Singularity at baseURL, the one its credentials
+// are sent to.
+func authHost(baseURL string) string {
+	u, err := neturl.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// basicAuthTransport sets the Authorization header of each request to host to
+// user's credentials. Requests elsewhere, as when a redirect leaves the
+// Singularity, go without them.
+type basicAuthTransport struct {
+	base http.RoundTripper
+	user *neturl.Userinfo
+	host string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+	pass, _ := t.user.Password()
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.user.Username(), pass)
+	return t.base.RoundTrip(req)
+}
+
+// preflight checks that the Singularity at url answers, with a request for
+// its (cached) state, so that a scan doesn't start against a cluster that
+// can't be reached or won't have us.
+func preflight(client *singularity.Client, url string) error {
+	_, err := client.GetState(false, false)
+	if rerr, is := err.(*swaggering.ReqError); is {
+		switch rerr.Status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("Singularity at %s refused access (%d %s); check credentials", url, rerr.Status, http.StatusText(rerr.Status))
+		case http.StatusNotFound:
+			return fmt.Errorf("No Singularity API at %s (404 for /api/state); check the URL", url)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Can't reach Singularity at %s: %v", url, err)
+	}
+	return nil
+}
+
+// clusterInfo describes the Singularity at url from its /api/state: its
+// leading scheduler host and what it is running. Details the state leaves
+// out are omitted.
+func clusterInfo(client *singularity.Client, url string) (string, error) {
+	state, err := client.GetState(false, false)
+	if err != nil {
+		return "", err
+	}
+
+	info := fmt.Sprintf("Singularity at %s", url)
+	for _, host := range state.HostStates {
+		if host.Master && host.Hostname != "" {
+			info += fmt.Sprintf(", led by %s", host.Hostname)
+			if host.MesosMaster != "" {
+				info += fmt.Sprintf(" (mesos master %s)", host.MesosMaster)
+			}
+		}
+	}
+	info += fmt.Sprintf(": %d active requests, %d active tasks, %d active agents",
+		state.ActiveRequests, state.ActiveTasks, state.ActiveSlaves)
+	if state.GeneratedAt > 0 {
+		info += fmt.Sprintf("; state as of %s", time.Unix(0, state.GeneratedAt*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+	}
+	return info, nil
+}
+
+// checkRedirect follows at most max redirects for each request.
+func checkRedirect(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("not following redirect to %s: --max-redirects is %d", req.URL, max)
+		}
+		return nil
+	}
+}
+
+// retryTransport spaces requests out according to its limiter, gives each
+// attempt at a request up to timeout (if set) to complete, and retries
+// requests refused with 429 once the server's Retry-After has passed, or that
+// timed out.
+type retryTransport struct {
+	base       http.RoundTripper
+	limiter    *rateLimiter
+	maxRetries int
+	timeout    time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			if err := t.limiter.Wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		atomic.AddInt64(&apiCalls, 1)
+		res, err := t.try(req)
+		// Requests with bodies can't be replayed safely.
+		if attempt >= t.maxRetries || req.Body != nil {
+			return res, err
+		}
+
+		if err != nil {
+			if !t.timedOut(req, err) {
+				return res, err
+			}
+			delay := retryAfter("", attempt)
+			debug("Timed out on %s, retrying in %s", req.URL, delay)
+			time.Sleep(delay)
+			continue
+		}
+		if res.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+
+		delay := retryAfter(res.Header.Get("Retry-After"), attempt)
+		res.Body.Close()
+		debug("Throttled on %s, retrying in %s", req.URL, delay)
+		time.Sleep(delay)
+	}
+}
+
+// try makes one attempt at req, which has until t.timeout to complete,
+// including reading the response body.
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelingBody{res.Body, cancel}
+	return res, nil
+}
+
+// timedOut is true of errors from an attempt at req running out of time,
+// rather than req itself being cancelled.
+func (t *retryTransport) timedOut(req *http.Request, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// cancelingBody releases the context of an attempt once its body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// retryAfter interprets a Retry-After header, either delay-seconds or an
+// HTTP date. Without one it backs off exponentially from a second.
+func retryAfter(header string, attempt int) time.Duration {
+	delay := time.Second << uint(attempt)
+	if secs, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		delay = time.Until(at)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
+
+// rateLimiter hands out evenly spaced slots to callers of Wait.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// errLimiterDeadline is returned by Wait without waiting when the caller's
+// slot is past the deadline of its context.
+var errLimiterDeadline = errors.New("rate limit: no slot before the deadline")
+
+// Wait blocks until the caller's slot, or until ctx is done. As with
+// golang.org/x/time/rate's Limiter, a caller that gives up doesn't use up
+// capacity: one whose slot would come after ctx's deadline fails at once
+// without taking it, and one that's cancelled hands its slot back, unless
+// later callers already hold the slots after it.
+func (rl *rateLimiter) Wait(ctx context.Context) error {
+	rl.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	slot := rl.next
+	if deadline, ok := ctx.Deadline(); ok && slot.After(deadline) {
+		rl.Unlock()
+		return errLimiterDeadline
+	}
+	rl.next = rl.next.Add(rl.interval)
+	rl.Unlock()
+
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		rl.cancel(slot)
+		return ctx.Err()
+	}
+}
+
+// cancel hands back the slot a caller gave up, if it's the last one taken.
+func (rl *rateLimiter) cancel(slot time.Time) {
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.next.Equal(slot.Add(rl.interval)) {
+		rl.next = slot
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// column produces one named column of output for each task.
+type column struct {
+	header string
+	value  func(td *taskDesc) string
+}
+
+const envColumnPrefix = "env:"
+
+// columnProducers are the columns that can be named in --columns.
+// Environment variables are selected with "env:NAME".
+var columnProducers = map[string]column{
+	"req":    {"Request ID", func(td *taskDesc) string { return td.SingularityTaskId.RequestId }},
+	"deploy": {"Deploy ID", func(td *taskDesc) string { return td.SingularityTaskId.DeployId }},
+	"task":   {"Task ID", func(td *taskDesc) string { return td.SingularityTaskId.Id }},
+	"state":  {"State", (*taskDesc).deployState},
+	"status": {"Task Status", (*taskDesc).status},
+	"docker": {"Docker Image", func(td *taskDesc) string {
+		if td.DockerInfo == nil {
+			return "<? none ?>"
+		}
+		return td.DockerInfo.Image
+	}},
+	"cpu":       {"CPU Used/Alloc", (*taskDesc).cpuUsage},
+	"mem":       {"Mem Used/Alloc", (*taskDesc).memUsage},
+	"agent":     {"Agent ID", (*taskDesc).agentID},
+	"health":    {"Health", (*taskDesc).health},
+	"launch":    {"Launch Latency", (*taskDesc).launchLatencyString},
+	"result":    {"Deploy Result", (*taskDesc).deployResult},
+	"stale":     {"Stale Deploy", (*taskDesc).staleDeployString},
+	"schedule":  {"Schedule", (*taskDesc).schedule},
+	"container": {"Container", (*taskDesc).containerType},
+	"rack":      {"Rack", (*taskDesc).rack},
+	"lastseen":  {"Last Seen", (*taskDesc).lastSeenString},
+	"registry":  {"Registry", (*taskDesc).registry},
+	"oom": {"OOM", func(td *taskDesc) string {
+		if td.oom() {
+			return "OOM"
+		}
+		return ""
+	}},
+	"message": {"Message", func(td *taskDesc) string {
+		return strings.Join(strings.Fields(td.message()), " ")
+	}},
+}
+
+func envColumn(name string) column {
+	return column{name, func(td *taskDesc) string { return td.envVar(name) }}
+}
+
+func columnNames() []string {
+	names := []string{}
+	for name := range columnProducers {
+		names = append(names, name)
+	}
+	names = append(names, flapColumnName)
+	sort.Strings(names)
+	return append(names, envColumnPrefix+"NAME")
+}
+
+// flapColumn is named apart from the columnProducers, as it depends on
+// --flap-threshold and --flap-window.
+const (
+	flapColumnName   = "flapping"
+	flapColumnHeader = "Flapping"
+)
+
+// lookupColumn finds the column called name in --columns terms.
+func lookupColumn(name string, opts *options) (column, error) {
+	if strings.HasPrefix(name, envColumnPrefix) {
+		return envColumn(strings.TrimPrefix(name, envColumnPrefix)), nil
+	}
+	if name == flapColumnName {
+		return flapColumn(opts), nil
+	}
+	col, ok := columnProducers[name]
+	if !ok {
+		return column{}, fmt.Errorf("unknown column %q; expected one of: %s", name, strings.Join(columnNames(), ", "))
+	}
+	return col, nil
+}
+
+func parseColumns(spec string, opts *options) ([]column, error) {
+	cols := []column{}
+	for _, name := range strings.Split(spec, ",") {
+		col, err := lookupColumn(strings.TrimSpace(name), opts)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// withoutDocker drops the docker column from cols, for --no-docker.
+func withoutDocker(cols []column) []column {
+	kept := []column{}
+	for _, col := range cols {
+		if col.header != columnProducers["docker"].header {
+			kept = append(kept, col)
+		}
+	}
+	return kept
+}
+
+// flapColumn marks tasks that are flapping, with the count of tasks their
+// deploy replaced within the --flap-window.
+func flapColumn(opts *options) column {
+	return column{flapColumnHeader, func(td *taskDesc) string {
+		if !td.flapping(opts) {
+			return ""
+		}
+		return fmt.Sprintf("flapping (%d replaced)", td.replacements(opts.flapWindow))
+	}}
+}
+
+// missingEnvColumn lists the --require-env variables each task lacks.
+func missingEnvColumn(opts *options) column {
+	return column{"Missing Env", func(td *taskDesc) string {
+		return strings.Join(td.missingEnv(opts), ",")
+	}}
+}
+
+// defaultColumns selects columns from the individual --print-* flags.
+func defaultColumns(opts *options) []column {
+	cols := []column{columnProducers["req"], columnProducers["deploy"]}
+
+	if opts.printPending || opts.printActive {
+		cols = append(cols, columnProducers["state"])
+	}
+	for _, e := range opts.env {
+		cols = append(cols, envColumn(e))
+	}
+	if opts.printStatus {
+		cols = append(cols, columnProducers["status"])
+	}
+	if opts.printContainerType {
+		cols = append(cols, columnProducers["container"])
+	}
+	if opts.printDockerImage && !opts.noDocker {
+		cols = append(cols, columnProducers["docker"])
+	}
+	if opts.printRegistry {
+		cols = append(cols, columnProducers["registry"])
+	}
+	if opts.printUsage {
+		cols = append(cols, columnProducers["cpu"], columnProducers["mem"])
+	}
+	if opts.printAgent {
+		cols = append(cols, columnProducers["agent"])
+	}
+	if opts.printRack {
+		cols = append(cols, columnProducers["rack"])
+	}
+	if opts.printMessage {
+		cols = append(cols, columnProducers["message"])
+	}
+	if opts.printHealth {
+		cols = append(cols, columnProducers["health"])
+	}
+	if opts.printLaunchLatency {
+		cols = append(cols, columnProducers["launch"])
+	}
+	if opts.printDeployState {
+		cols = append(cols, columnProducers["result"])
+	}
+	if opts.printStaleDeploy {
+		cols = append(cols, columnProducers["stale"])
+	}
+	if opts.flapping {
+		cols = append(cols, flapColumn(opts))
+	}
+	if opts.printSchedule {
+		cols = append(cols, columnProducers["schedule"])
+	}
+	if opts.printLastSeen {
+		cols = append(cols, columnProducers["lastseen"])
+	}
+	if len(opts.requireEnv) > 0 {
+		cols = append(cols, missingEnvColumn(opts))
+	}
+	return cols
+}
+
+// nonEnvColumns is the column selection without any environment variables.
+func nonEnvColumns(opts *options) []column {
+	if opts.columns == "" {
+		noEnv := *opts
+		noEnv.env = nil
+		return defaultColumns(&noEnv)
+	}
+
+	cols := []column{}
+	for _, name := range strings.Split(opts.columns, ",") {
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(name, envColumnPrefix) {
+			continue
+		}
+		if col, err := lookupColumn(name, opts); err == nil {
+			cols = append(cols, col)
+		}
+	}
+	if opts.noDocker {
+		return withoutDocker(cols)
+	}
+	return cols
+}
+
+func headerNames(opts *options) []string {
+	headers := []string{}
+	for _, col := range opts.outputColumns {
+		headers = append(headers, col.header)
+	}
+	return headers
+}
+
+func taskValues(opts *options, td *taskDesc) []string {
+	if td.placeholder() {
+		return placeholderValues(opts.outputColumns, td)
+	}
+	vals := []string{}
+	for _, col := range opts.outputColumns {
+		vals = append(vals, columnValue(col, td, opts))
+	}
+	return vals
+}
+
+// columnValue is col's value for td, as displayed: --short-states shortens
+// the task status.
+func columnValue(col column, td *taskDesc, opts *options) string {
+	value := col.value(td)
+	if opts.shortStates && col.header == columnProducers["status"].header {
+		return shortState(value)
+	}
+	return value
+}
+
+// shortState turns a state like TASK_RUNNING into "running".
+func shortState(state string) string {
+	return strings.ToLower(strings.TrimPrefix(state, "TASK_"))
+}
+
+// placeholderValues fills a row for a request without tasks: its ID in the
+// request column, its deploy result in the result column, and "no tasks" in
+// the first other column.
+func placeholderValues(cols []column, td *taskDesc) []string {
+	vals := make([]string, len(cols))
+	noted := false
+	for i, col := range cols {
+		if col.header == columnProducers["req"].header {
+			vals[i] = td.SingularityTaskId.RequestId
+		} else if col.header == columnProducers["result"].header {
+			vals[i] = td.deployResult()
+		} else if !noted {
+			vals[i] = "no tasks"
+			noted = true
+		}
+	}
+	return vals
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// compareTaskEnvs prints the differences between the environments of the
+// tasks taskA and taskB, colored when stdout is a terminal.
+func compareTaskEnvs(opts *options, taskA, taskB string) {
+	a := (&taskDesc{findTask(opts, taskA)}).decoded(opts).redacted(opts)
+	b := (&taskDesc{findTask(opts, taskB)}).decoded(opts).redacted(opts)
+
+	dest, closeDest, err := openDestination(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	color := opts.output == "" && isTerminal(os.Stdout)
+	compareEnvs(dest, taskA, taskB, envMap(a, opts), envMap(b, opts), color)
+	if err := closeDest(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// envMap is the environment of td, less any --env-exclude variables.
+func envMap(td *taskDesc, opts *options) map[string]string {
+	env := map[string]string{}
+	for _, pair := range longEnv(td, opts) {
+		env[pair[0]] = pair[1]
+	}
+	return env
+}
+
+// compareEnvs writes the variables of a and b that differ in the manner of a
+// unified diff: removed or changed from a with "-", added or changed in b
+// with "+".
+func compareEnvs(out io.Writer, nameA, nameB string, a, b map[string]string, color bool) {
+	line := func(sign, code, name, value string) {
+		if color {
+			fmt.Fprintf(out, "%s%s%s=%s%s\n", code, sign, name, value, colorReset)
+			return
+		}
+		fmt.Fprintf(out, "%s%s=%s\n", sign, name, value)
+	}
+
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, have := a[name]; !have {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", nameA, nameB)
+	for _, name := range names {
+		was, inA := a[name]
+		is, inB := b[name]
+		if inA && inB && was == is {
+			continue
+		}
+		if inA {
+			line("-", colorRed, name, was)
+		}
+		if inB {
+			line("+", colorGreen, name, is)
+		}
+	}
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,9 +34,15 @@ var schema = []string{
 		last_query_for_inactive timestamp,
 		last_query_for_pending timestamp
 	);`,
+	`create table run(
+		run_id integer primary key autoincrement,
+		run_ident string unique,
+		started_at timestamp
+	);`,
 	`create table req(
 		req_id integer primary key autoincrement,
 		singularity_id references singularity on delete cascade,
+		run_id references run on delete cascade,
 		request_ident string,
 		instances integer,
 		type string,
@@ -39,6 +52,7 @@ var schema = []string{
 	`create table task(
 		task_id integer primary key autoincrement,
 		req_id references req on delete cascade,
+		task_ident string,
 		deploy_ident string,
 		status string
 	);`,
@@ -53,93 +67,214 @@ var schema = []string{
 		task_id references task on delete cascade,
 		image_name string
 	);`,
+	"create index req_request_ident on req(request_ident);",
+	"create index task_status on task(status);",
+	"create index env_task_id on env(task_id);",
 }
 
-var now = time.Now()
+// nowFunc is the clock read when opening the database, and for how long ago
+// tasks were last seen. Tests may replace it to fix the time of captures.
+var nowFunc = time.Now
 
 type database struct {
 	db *sql.DB
+	// path is the file the database is in.
+	path string
 	sync.Mutex
+	// now is when the database was opened, the time of the captures this
+	// invocation adds.
+	now time.Time
+	// runID is the run captures are recorded in, once startRun has begun
+	// one. Until then they belong to no run.
+	runID sql.NullInt64
 }
 
-func newDB() *database {
-	db, err := openDB()
-	if err != nil {
-		panic(err)
+// dbOpenTimeout bounds the time newDB spends retrying, for instance while
+// another cygnus holds the database locked.
+const dbOpenTimeout = 2 * time.Second
+
+var errStaleSchema = errors.New("database schema is out of date; refusing to clobber it with --append (move it aside, or drop --append to recreate it)")
+
+// newDB opens the database at path, recreating it if its schema is out of
+// date. With keep set, it returns an error instead of discarding the
+// recorded data. Other failures are retried, after a jittered backoff,
+// for up to dbOpenTimeout.
+func newDB(path string, keep bool) (*database, error) {
+	deadline := time.Now().Add(dbOpenTimeout)
+	for attempt := uint(0); ; attempt++ {
+		db, err := tryDB(path, keep)
+		if err == nil || err == errStaleSchema || time.Now().After(deadline) {
+			return db, err
+		}
+		delay := dbRetryDelay(attempt)
+		debug("Opening database %q: %v; retrying in %s", path, err, delay)
+		time.Sleep(delay)
 	}
+}
+
+// dbRetryDelay doubles from 25ms up to 400ms, less up to half at random so
+// that competing invocations spread out.
+func dbRetryDelay(attempt uint) time.Duration {
+	if attempt > 4 {
+		attempt = 4
+	}
+	delay := 25 * time.Millisecond << attempt
+	return delay - time.Duration(mathrand.Int63n(int64(delay/2)))
+}
 
-	sqlExec(db, "pragma foreign_keys = ON;")
-	err = groom(db)
+func tryDB(path string, keep bool) (*database, error) {
+	now := nowFunc()
+	db, err := openDB(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &database{
-		db: db,
+	if err := sqlExec(db, "pragma foreign_keys = ON;"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := groom(db, keep, now); err != nil {
+		db.Close()
+		return nil, err
 	}
+
+	return &database{
+		db:   db,
+		path: path,
+		now:  now,
+	}, nil
 }
 
 func (db *database) close() {
 	db.db.Close()
 }
 
-func (db *database) addTask(desc *taskDesc) {
-	var id int64
-	var err error
+// startRun records the start of a scan run, to which the captures added
+// from now on belong, and returns its generated ID.
+func (db *database) startRun() (string, error) {
+	ident, err := newRunIdent()
+	if err != nil {
+		return "", err
+	}
+	return ident, db.addRun(ident)
+}
 
+// addRun records the run with ID ident, to which the captures added from
+// now on belong.
+func (db *database) addRun(ident string) error {
 	db.Lock()
 	defer db.Unlock()
+	stmt, err := db.db.Exec("insert into run (run_ident, started_at) values ($1, $2)", ident, db.now)
+	if err != nil {
+		return fmt.Errorf("recording run: %v", err)
+	}
+	id, err := stmt.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting new run db id: %v", err)
+	}
+	db.runID = sql.NullInt64{Int64: id, Valid: true}
+	debug("Recording run %s", ident)
+	return nil
+}
 
-	sid, err := db.addSing(desc.url)
+// newRunIdent is a random (version 4) UUID.
+func newRunIdent() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
 
-	if desc.SingularityRequestParent == nil {
-		id, err = db.addReq(sid, 0, desc.SingularityTaskId.RequestId, "UNKNOWN", "UNKNOWN")
-	} else {
-		id, err = db.addReq(
-			sid,
-			desc.SingularityRequestParent.Request.Instances,
-			desc.SingularityRequestParent.Request.Id,
-			string(desc.SingularityRequestParent.Request.RequestType),
-			string(desc.SingularityRequestParent.State),
-		)
+// writeTasks records each task received on tasks, so that a single goroutine
+// does all the writing. It closes done once tasks is closed and drained.
+func (db *database) writeTasks(tasks <-chan *taskDesc, done chan<- struct{}) {
+	for desc := range tasks {
+		db.addTask(desc)
 	}
+	close(done)
+}
 
-	if err != nil {
-		debug("error getting request: %v", err)
-		return
+func (db *database) addTask(desc *taskDesc) {
+	if err := db.addRecord(desc.dbRecord(db.now)); err != nil {
+		debug("error recording task %s: %v", desc.SingularityTaskId.Id, err)
 	}
+}
 
-	status := "UNKNOWN"
+// dbRecord is the part of desc kept in the database, captured at at.
+func (desc *taskDesc) dbRecord(at time.Time) *exportedTask {
+	rec := &exportedTask{
+		URL:          desc.URL,
+		RequestID:    desc.SingularityTaskId.RequestId,
+		RequestType:  "UNKNOWN",
+		RequestState: "UNKNOWN",
+		CapturedAt:   at,
+		TaskID:       desc.SingularityTaskId.Id,
+		DeployID:     desc.SingularityTaskId.DeployId,
+		Status:       "UNKNOWN",
+		Env:          map[string]string{},
+	}
+	if req := desc.SingularityRequestParent; req != nil {
+		rec.Instances = int64(req.Request.Instances)
+		rec.RequestID = req.Request.Id
+		rec.RequestType = string(req.Request.RequestType)
+		rec.RequestState = string(req.State)
+	}
 	if desc.SingularityTaskHistoryUpdate != nil {
-		status = string(desc.SingularityTaskHistoryUpdate.TaskState)
+		rec.Status = string(desc.SingularityTaskHistoryUpdate.TaskState)
+	}
+	if env := desc.Env(); env != nil {
+		for _, vrb := range env.Variables {
+			rec.Env[vrb.Name] = vrb.Value
+		}
+	}
+	if desc.DockerInfo != nil {
+		rec.DockerImage = desc.DockerInfo.Image
 	}
-	debug("insert into task (req_id, deploy_ident, status) values (%v, %v, %v)", id, desc.SingularityTaskId.DeployId, status)
-	stmt, err := db.db.Exec("insert into task (req_id, deploy_ident, status) values ($1, $2, $3)",
-		id, desc.SingularityTaskId.DeployId, status)
+	return rec
+}
+
+// addRecord stores a task, with its request and Singularity, in the capture
+// of the request taken at rec.CapturedAt.
+func (db *database) addRecord(rec *exportedTask) error {
+	db.Lock()
+	defer db.Unlock()
 
+	sid, err := db.addSing(rec.URL)
 	if err != nil {
-		debug("error inserting task: %v", err)
-		return
+		return err
+	}
+
+	id, err := db.addReq(sid, int32(rec.Instances), rec.RequestID, rec.RequestType, rec.RequestState, rec.CapturedAt)
+	if err != nil {
+		return fmt.Errorf("getting request: %v", err)
+	}
+
+	debug("insert into task (req_id, task_ident, deploy_ident, status) values (%v, %v, %v, %v)", id, rec.TaskID, rec.DeployID, rec.Status)
+	stmt, err := db.db.Exec("insert into task (req_id, task_ident, deploy_ident, status) values ($1, $2, $3, $4)",
+		id, rec.TaskID, rec.DeployID, rec.Status)
+	if err != nil {
+		return fmt.Errorf("inserting task: %v", err)
 	}
 	id, err = stmt.LastInsertId()
 	if err != nil {
-		debug("error getting new task db id: %v", err)
-		return
+		return fmt.Errorf("getting new task db id: %v", err)
 	}
 
-	for _, vrb := range desc.Env().Variables {
-		db.db.Exec("insert into env (task_id, name, value) values ($1, $2, $3)", id, vrb.Name, vrb.Value)
-		if err != nil {
-			debug("error inserting task env pair (%q: %q): %v", vrb.Name, vrb.Value, err)
+	for name, value := range rec.Env {
+		if _, err := db.db.Exec("insert into env (task_id, name, value) values ($1, $2, $3)", id, name, value); err != nil {
+			return fmt.Errorf("inserting task env pair (%q: %q): %v", name, value, err)
 		}
 	}
 
-	if desc.DockerInfo != nil {
-		db.db.Exec("insert into docker_image (task_id, image_name) values ($1, $2)", id, desc.DockerInfo.Image)
-		if err != nil {
-			debug("error inserting task docker image (%q): %v", desc.DockerInfo.Image, err)
+	if rec.DockerImage != "" {
+		if _, err := db.db.Exec("insert into docker_image (task_id, image_name) values ($1, $2)", id, rec.DockerImage); err != nil {
+			return fmt.Errorf("inserting task docker image (%q): %v", rec.DockerImage, err)
 		}
 	}
+	return nil
 }
 
 func (db *database) addSing(url string) (int64, error) {
@@ -171,21 +306,25 @@ func (db *database) addSing(url string) (int64, error) {
 	return stmt.LastInsertId()
 }
 
-func (db *database) addReq(singID int64, instances int32, reqID, reqType, state string) (int64, error) {
-	rows, err := db.db.Query("select req_id, captured_at from req where request_ident = $1 and singularity_id = $2", reqID, singID)
-	defer rows.Close()
+// addReq finds the capture of a request in the current run taken within a
+// second of capturedAt, or adds one.
+func (db *database) addReq(singID int64, instances int32, reqID, reqType, state string, capturedAt time.Time) (int64, error) {
+	rows, err := db.db.Query("select req_id, captured_at from req where request_ident = $1 and singularity_id = $2 and run_id is $3", reqID, singID, db.runID)
 	if err != nil {
 		return 0, err
 	}
+	defer rows.Close()
 
-	var id int64
-	var captureTime time.Time
 	for rows.Next() {
+		var id int64
+		var captureTime time.Time
 		if err := rows.Scan(&id, &captureTime); err != nil {
 			return 0, err
 		}
-		debug("Found existing request: %q = %d", reqID, id)
-		break
+		if delta := capturedAt.Sub(captureTime); delta < time.Second && delta > -time.Second {
+			debug("Found existing request: %q = %d", reqID, id)
+			return id, nil
+		}
 	}
 
 	rows.Close()
@@ -193,19 +332,10 @@ func (db *database) addReq(singID int64, instances int32, reqID, reqType, state
 		return 0, err
 	}
 
-	if id != 0 {
-		if now.Sub(captureTime) < (1 * time.Second) {
-			return id, nil
-		}
-
-		debug("Found stale request - deleting")
-		db.db.Exec("delete from req where req_id = $1", id)
-	}
-
 	debug("No existing request for %q", reqID)
 
-	stmt, err := db.db.Exec("insert into req (singularity_id, request_ident, instances, type, state, captured_at) values ($1, $2, $3, $4, $5, $6)",
-		singID, reqID, instances, reqType, state, now)
+	stmt, err := db.db.Exec("insert into req (singularity_id, run_id, request_ident, instances, type, state, captured_at) values ($1, $2, $3, $4, $5, $6, $7)",
+		singID, db.runID, reqID, instances, reqType, state, capturedAt)
 	if err != nil {
 		return 0, err
 	}
@@ -213,19 +343,80 @@ func (db *database) addReq(singID int64, instances int32, reqID, reqType, state
 	return stmt.LastInsertId()
 }
 
-func openDB() (*sql.DB, error) {
-	dbFile := filepath.Join(os.TempDir(), "cygnus.db")
+func defaultDBPath() string {
+	return filepath.Join(os.TempDir(), "cygnus.db")
+}
 
+func openDB(dbFile string) (*sql.DB, error) {
 	debug("Recording data to %q.", dbFile)
 
-	return sql.Open("sqlite3", "file:"+dbFile)
+	db, err := sql.Open("sqlite3", "file:"+dbFile)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite serializes writers on a lock over the whole file, so a pool of
+	// connections only contends for it; the writes go through one goroutine
+	// anyway. A single connection also keeps per-connection pragmas, like
+	// foreign_keys, in force for every statement.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// openReadOnly opens the database at path without creating it, or allowing
+// any change to it.
+func openReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
 }
 
-func groom(db *sql.DB) error {
+// readDB opens the database at path to read the captures it holds, for diff
+// and export. Unlike newDB, it never recreates the database: it is an error
+// for its schema to be out of date.
+func readDB(path string) (*database, error) {
+	db, err := openReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	var fingerprint string
+	if err := db.QueryRow("select value from _database_metadata_ where name = 'fingerprint';").Scan(&fingerprint); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reading the schema fingerprint of %s: %v", path, err)
+	}
+	if fingerprint != fingerPrintSchema(schema) {
+		db.Close()
+		return nil, fmt.Errorf("%s was made with a different schema, which this cygnus can't read (see db-info)", path)
+	}
+	return &database{db: db, path: path, now: nowFunc()}, nil
+}
+
+func groom(db *sql.DB, keep bool, now time.Time) error {
 	var tgp string
 	schemaFingerprint := fingerPrintSchema(schema)
 	err := db.QueryRow("select value from _database_metadata_ where name = 'fingerprint';").Scan(&tgp)
+	if err != nil && err != sql.ErrNoRows && !noSuchTable(err) {
+		// Such as the database being locked by another cygnus: newDB tries
+		// again rather than discarding what that one is recording.
+		return fmt.Errorf("reading schema fingerprint: %v", err)
+	}
 	if err != nil || tgp != schemaFingerprint {
+		// Whatever is in the file, --append keeps it: only an empty one is
+		// made over.
+		if keep {
+			var objects int
+			if err := db.QueryRow("select count(*) from sqlite_master;").Scan(&objects); err != nil {
+				return err
+			}
+			if objects > 0 {
+				return errStaleSchema
+			}
+		}
 		debug("Clobbering DB: %v, %q ?= %q", err, tgp, schemaFingerprint)
 		if err := clobber(db); err != nil {
 			return err
@@ -247,6 +438,87 @@ func groom(db *sql.DB) error {
 	return nil
 }
 
+// DBInfo describes the database at Path, for db-info.
+type DBInfo struct {
+	Path               string `json:"path"`
+	Exists             bool   `json:"exists"`
+	Fingerprint        string `json:"fingerprint,omitempty"`
+	Created            string `json:"created,omitempty"`
+	CurrentFingerprint string `json:"currentFingerprint"`
+	// Clobber is whether the next scan will recreate the database,
+	// discarding what it holds.
+	Clobber bool `json:"clobber"`
+}
+
+// readDBInfo reads the metadata of the database at path, without the
+// grooming of newDB, so that it changes nothing.
+func readDBInfo(path string) (DBInfo, error) {
+	info := DBInfo{Path: path, CurrentFingerprint: fingerPrintSchema(schema)}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return info, err
+	}
+	info.Exists, info.Clobber = true, true
+
+	db, err := openReadOnly(path)
+	if err != nil {
+		return info, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("select name, value from _database_metadata_;")
+	if err != nil {
+		// Not a database cygnus made, or too old to have metadata.
+		debug("Reading metadata of %q: %v", path, err)
+		return info, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return info, err
+		}
+		switch name {
+		case "fingerprint":
+			info.Fingerprint = value.String
+		case "created":
+			info.Created = value.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return info, err
+	}
+	info.Clobber = info.Fingerprint != info.CurrentFingerprint
+	return info, nil
+}
+
+// printDBInfo writes info to w as JSON, and explains on stderr what the next
+// scan will do to a database it would recreate.
+func printDBInfo(info DBInfo, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(info); err != nil {
+		return err
+	}
+	switch {
+	case !info.Exists:
+		log.Printf("%s doesn't exist; the next scan will create it", info.Path)
+	case info.Fingerprint == "":
+		log.Printf("%s has no schema fingerprint; the next scan will recreate it, discarding its contents (--append refuses to)", info.Path)
+	case info.Clobber:
+		log.Printf("%s was made with a different schema; the next scan will recreate it, discarding its contents (--append refuses to)", info.Path)
+	}
+	return nil
+}
+
+// noSuchTable is true of the error sqlite reports for a missing table.
+func noSuchTable(err error) bool {
+	return strings.HasPrefix(err.Error(), "no such table")
+}
+
 func fingerPrintSchema(schema []string) string {
 	h := sha256.New()
 	for i, s := range schema {
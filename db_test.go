@@ -0,0 +1,486 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchemaIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cygnus.db")
+	db, err := newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the file was made by an older cygnus, without the indexes.
+	for _, index := range []string{"req_request_ident", "task_status", "env_task_id"} {
+		sqlExec(db.db, "drop index "+index)
+	}
+	sqlExec(db.db, "update _database_metadata_ set value = 'old' where name = 'fingerprint'")
+	db.close()
+
+	db, err = newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	var count int
+	err = db.db.QueryRow("select count(*) from sqlite_master where type = 'index' and name in ('req_request_ident', 'task_status', 'env_task_id')").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("found %d of the 3 indexes after grooming", count)
+	}
+}
+
+func TestRequestLookupTiming(t *testing.T) {
+	db, err := newDB(filepath.Join(t.TempDir(), "cygnus.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	sid, err := db.addSing("http://singularity.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A thousand requests, captured fifty times each.
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for capture := 0; capture < 50; capture++ {
+		at := db.now.Add(-time.Duration(capture) * time.Hour)
+		for req := 0; req < 1000; req++ {
+			res, err := tx.Exec("insert into req (singularity_id, request_ident, captured_at) values ($1, $2, $3)",
+				sid, fmt.Sprintf("req-%d", req), at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := res.LastInsertId()
+			tx.Exec("insert into task (req_id, status) values ($1, 'TASK_RUNNING')", id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var plan strings.Builder
+	rows, err := db.db.Query("explain query plan select req_id, captured_at from req where request_ident = $1 and singularity_id = $2", "req-1", sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		rows.Scan(&id, &parent, &notused, &detail)
+		plan.WriteString(detail + "\n")
+	}
+	rows.Close()
+	if !strings.Contains(plan.String(), "req_request_ident") {
+		t.Errorf("request lookup doesn't use the index:\n%s", plan.String())
+	}
+
+	start := time.Now()
+	for req := 0; req < 1000; req++ {
+		if _, err := db.addReq(sid, 1, fmt.Sprintf("req-%d", req), "SERVICE", "ACTIVE", db.now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	t.Logf("1000 request lookups against 50000 captures took %s", elapsed)
+	if elapsed > 10*time.Second {
+		t.Errorf("request lookups took %s", elapsed)
+	}
+}
+
+func TestRunsSeparateCaptures(t *testing.T) {
+	db, err := newDB(filepath.Join(t.TempDir(), "cygnus.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	record := func(status string) string {
+		run, err := db.startRun()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.addRecord(&exportedTask{
+			URL: "http://sing", RequestID: "web", CapturedAt: db.now,
+			TaskID: "web-1", Status: status, Env: map[string]string{},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+	first, second := record("TASK_STARTING"), record("TASK_RUNNING")
+
+	tasks, err := db.exportedTasks(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].RunID != first || tasks[0].Status != "TASK_STARTING" {
+		t.Errorf("run %s exported as %+v", first, tasks)
+	}
+
+	// run_id comes last in the CSV, after the columns exported before runs.
+	csvOut := &strings.Builder{}
+	if err := exportDB(db, "csv", first, csvOut); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csvOut.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], ",env,run_id") || !strings.HasSuffix(lines[1], ","+first) {
+		t.Errorf("run %s exported as CSV:\n%s", first, csvOut)
+	}
+
+	buf := &strings.Builder{}
+	if err := diffCaptures(db, "web", "", second, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "TASK_STARTING -> TASK_RUNNING") {
+		t.Errorf("diff of run %s:\n%s", second, buf)
+	}
+}
+
+func TestWriteSqlite(t *testing.T) {
+	dir := t.TempDir()
+	db, err := newDB(filepath.Join(dir, "cygnus.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	var runs []string
+	for _, status := range []string{"TASK_STARTING", "TASK_RUNNING"} {
+		run, err := db.startRun()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.addRecord(&exportedTask{
+			URL: "http://sing", RequestID: "web", CapturedAt: db.now,
+			TaskID: "web-1", Status: status, Env: map[string]string{"PORT0": "31001"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, run)
+	}
+
+	path := filepath.Join(dir, "capture.sqlite")
+	if err := ioutil.WriteFile(path, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSqlite(db, runs[1], path); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := newDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.close()
+	tasks, err := out.exportedTasks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].RunID != runs[1] || tasks[0].Status != "TASK_RUNNING" || tasks[0].Env["PORT0"] != "31001" {
+		t.Errorf("wrote %+v", tasks)
+	}
+}
+
+func TestWriteSqliteOverDBPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cygnus.db")
+	db, err := newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	run, err := db.startRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, out := range []string{path, filepath.Join(dir, ".", "cygnus.db")} {
+		if err := writeSqlite(db, run, out); err == nil {
+			t.Errorf("writeSqlite to %s replaced the --db-path database", out)
+		}
+	}
+	if _, err := db.exportedTasks(run); err != nil {
+		t.Errorf("database unusable after refusal: %v", err)
+	}
+}
+
+func TestDiffPerSingularity(t *testing.T) {
+	db, err := newDB(filepath.Join(t.TempDir(), "cygnus.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	// Each run captures web at both Singularities; only sing-a's task changes.
+	for _, status := range []string{"TASK_STARTING", "TASK_RUNNING"} {
+		if _, err := db.startRun(); err != nil {
+			t.Fatal(err)
+		}
+		for url, status := range map[string]string{"http://sing-a": status, "http://sing-b": "TASK_FAILED"} {
+			if err := db.addRecord(&exportedTask{
+				URL: url, RequestID: "web", CapturedAt: db.now,
+				TaskID: "web-1", Status: status, Env: map[string]string{},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := diffCaptures(db, "web", "", "", &strings.Builder{}); err == nil || !strings.Contains(err.Error(), "http://sing-a, http://sing-b") {
+		t.Errorf("diff of a request at two Singularities: %v", err)
+	}
+	if err := diffCaptures(db, "web", "http://sing-c", "", &strings.Builder{}); err == nil {
+		t.Error("diff of a Singularity without captures: expected an error")
+	}
+
+	for url, want := range map[string]string{"http://sing-a": "TASK_STARTING -> TASK_RUNNING", "http://sing-b": ""} {
+		buf := &strings.Builder{}
+		if err := diffCaptures(db, "web", url, "", buf); err != nil {
+			t.Fatal(err)
+		}
+		changes := strings.SplitN(buf.String(), "\n", 3)[2]
+		if !strings.Contains(changes, want) || (want == "" && changes != "") {
+			t.Errorf("diff at %s:\n%s", url, buf)
+		}
+	}
+}
+
+func TestDBRetryDelay(t *testing.T) {
+	for attempt := uint(0); attempt < 10; attempt++ {
+		max := 25 * time.Millisecond << attempt
+		if max > 400*time.Millisecond {
+			max = 400 * time.Millisecond
+		}
+		if delay := dbRetryDelay(attempt); delay <= max/2 || delay > max {
+			t.Errorf("attempt %d waits %s, want (%s, %s]", attempt, delay, max/2, max)
+		}
+	}
+}
+
+func TestStaleSchemaNotRetried(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cygnus.db")
+	db, err := newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlExec(db.db, "update _database_metadata_ set value = 'old' where name = 'fingerprint'")
+	db.close()
+
+	start := time.Now()
+	if _, err := newDB(path, true); err != errStaleSchema {
+		t.Errorf("got %v, want errStaleSchema", err)
+	}
+	if elapsed := time.Since(start); elapsed > dbOpenTimeout/2 {
+		t.Errorf("took %s to refuse a stale schema", elapsed)
+	}
+}
+
+// freezeClock fixes the time newDB reads for the rest of the test.
+func freezeClock(t *testing.T, at time.Time) {
+	saved := nowFunc
+	nowFunc = func() time.Time { return at }
+	t.Cleanup(func() { nowFunc = saved })
+}
+
+func TestCapturesUseClock(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	freezeClock(t, at)
+
+	db, err := newDB(filepath.Join(t.TempDir(), "cygnus.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	if _, _, err := importDB(db, strings.NewReader(`{"requestId":"web","taskId":"web-1"}`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := db.exportedTasks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || !tasks[0].CapturedAt.Equal(at) {
+		t.Errorf("captured %+v, want one task at %s", tasks, at)
+	}
+}
+
+func TestDBInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cygnus.db")
+	info, err := readDBInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Exists || info.Clobber {
+		t.Errorf("missing database: got %+v", info)
+	}
+
+	db, err := newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = readDBInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Exists || info.Clobber || info.Fingerprint != info.CurrentFingerprint || info.Created == "" {
+		t.Errorf("fresh database: got %+v", info)
+	}
+
+	sqlExec(db.db, "update _database_metadata_ set value = 'old' where name = 'fingerprint'")
+	db.close()
+	info, err = readDBInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Fingerprint != "old" || !info.Clobber {
+		t.Errorf("stale database: got %+v", info)
+	}
+	if _, err := newDB(path, true); err != errStaleSchema {
+		t.Errorf("db-info said a stale database, but --append opened it: %v", err)
+	}
+}
+
+func TestReadDBLeavesStaleSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cygnus.db")
+	db, err := newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.addSing("http://singularity.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	sqlExec(db.db, "update _database_metadata_ set value = 'old' where name = 'fingerprint'")
+	db.close()
+
+	if _, err := readDB(path); err == nil {
+		t.Error("read a database with an out of date schema")
+	}
+	if _, err := readDB(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("read a database that doesn't exist")
+	}
+
+	if _, err := newDB(path, true); err != errStaleSchema {
+		t.Errorf("expected the schema to still be stale, got %v", err)
+	}
+}
+
+func TestAppendKeepsForeignDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "other.db")
+	raw, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlExec(raw, "create table notes(body text);"); err != nil {
+		t.Fatal(err)
+	}
+	sqlExec(raw, "insert into notes values ('keep me');")
+	raw.Close()
+
+	if _, err := newDB(path, true); err != errStaleSchema {
+		t.Errorf("got %v, want errStaleSchema", err)
+	}
+	raw, err = openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var body string
+	if err := raw.QueryRow("select body from notes;").Scan(&body); err != nil || body != "keep me" {
+		t.Errorf("--append lost the database's own table: %q, %v", body, err)
+	}
+
+	// A new, empty file is still set up.
+	db, err := newDB(filepath.Join(t.TempDir(), "new.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.close()
+}
+
+func TestGroomLockedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cygnus.db")
+	db, err := newDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.addSing("http://singularity.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Another cygnus in the middle of writing.
+	if err := sqlExec(db.db, "begin exclusive;"); err != nil {
+		t.Fatal(err)
+	}
+
+	impatient, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impatient.Close()
+	// The failure to read the fingerprint is returned for newDB to retry,
+	// before anything is dropped.
+	if err := groom(impatient, false, time.Now()); err == nil || !strings.Contains(err.Error(), "reading schema fingerprint") {
+		t.Errorf("grooming a locked database: got %v, want the fingerprint's read error", err)
+	}
+
+	sqlExec(db.db, "commit;")
+	var count int
+	if err := db.db.QueryRow("select count(*) from singularity;").Scan(&count); err != nil || count != 1 {
+		t.Errorf("after grooming while locked, found %d singularities (%v), want 1", count, err)
+	}
+	db.close()
+}
+
+func TestCaptureWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cygnus.db")
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Each capture is taken by a database opened at a frozen time, as by
+	// an invocation of cygnus then.
+	capture := func(offset time.Duration) int64 {
+		freezeClock(t, at.Add(offset))
+		db, err := newDB(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.close()
+		sid, err := db.addSing("http://sing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := db.addReq(sid, 1, "web", "SERVICE", "ACTIVE", db.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	first := capture(0)
+	for _, c := range []struct {
+		offset time.Duration
+		same   bool
+	}{
+		{999 * time.Millisecond, true},
+		{-999 * time.Millisecond, true},
+		{time.Second, false},
+		{-time.Second, false},
+	} {
+		id := capture(c.offset)
+		if same := id == first; same != c.same {
+			t.Errorf("capture %s after the first: reused it %v, want %v", c.offset, same, c.same)
+		}
+	}
+}
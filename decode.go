@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/base64"
+	"unicode/utf8"
+)
+
+// decoded is td with the values of the --decode-env variables base64-decoded,
+// for display. Values that don't decode to text are left as they are.
+func (td *taskDesc) decoded(opts *options) *taskDesc {
+	if len(opts.decodeEnv) == 0 {
+		return td
+	}
+	return td.withEnvValues(func(name, value string) string {
+		for _, d := range opts.decodeEnv {
+			if d == name {
+				return decodeBase64(value)
+			}
+		}
+		return value
+	})
+}
+
+// decodeBase64 decodes value as padded or unpadded base64, or returns it
+// unchanged if it isn't.
+func decodeBase64(value string) string {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+		if raw, err := enc.DecodeString(value); err == nil && utf8.Valid(raw) {
+			return string(raw)
+		}
+	}
+	return value
+}
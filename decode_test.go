@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestDecodeBase64(t *testing.T) {
+	for value, want := range map[string]string{
+		"aGVsbG8gd29ybGQ=": "hello world",
+		"aGVsbG8gd29ybGQ":  "hello world",
+		"31000":            "31000",
+		"/w==":             "/w==", // decodes, but not to text
+	} {
+		if got := decodeBase64(value); got != want {
+			t.Errorf("decodeBase64(%q) is %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestDecodedLeavesTaskAlone(t *testing.T) {
+	opts, tasks := scanFake(t, "--decode-env=PORT0")
+	td := tasks[0]
+	port := td.envVar("PORT0")
+
+	if got := td.decoded(opts).envVar("PORT0"); got != port {
+		t.Errorf("undecodable PORT0 %q displayed as %q", port, got)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+type capturedTask struct {
+	deployID, status string
+	env              map[string]string
+}
+
+type capture struct {
+	capturedAt time.Time
+	tasks      map[string]*capturedTask
+}
+
+// diffCaptures reports the differences between the two most recent
+// captures of a request in the database, from the Singularity at url. If run
+// isn't empty, the newer is the request's capture in the scan run with that
+// ID, and the older the one before it.
+func diffCaptures(db *database, requestID, url, run string, out io.Writer) error {
+	singID, err := db.captureSingularity(requestID, url)
+	if err != nil {
+		return err
+	}
+	rows, err := db.db.Query(`select r.req_id, r.captured_at, coalesce(ru.run_ident, '')
+		from req r left join run ru on ru.run_id = r.run_id
+		where r.request_ident = $1 and r.singularity_id = $2
+		order by r.captured_at desc, r.req_id desc`, requestID, singID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var times []time.Time
+	for len(ids) < 2 && rows.Next() {
+		var id int64
+		var at time.Time
+		var runIdent string
+		if err := rows.Scan(&id, &at, &runIdent); err != nil {
+			return err
+		}
+		if run != "" && len(ids) == 0 && runIdent != run {
+			continue
+		}
+		ids = append(ids, id)
+		times = append(times, at)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(ids) < 2 {
+		return fmt.Errorf("need two captures of %q to diff, found %d", requestID, len(ids))
+	}
+
+	newer, err := db.loadCapture(ids[0], times[0])
+	if err != nil {
+		return err
+	}
+	older, err := db.loadCapture(ids[1], times[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "--- %s %s\n", requestID, older.capturedAt.Format(time.RFC3339))
+	fmt.Fprintf(out, "+++ %s %s\n", requestID, newer.capturedAt.Format(time.RFC3339))
+
+	for _, ident := range taskIdents(older, newer) {
+		was, wasOK := older.tasks[ident]
+		is, isOK := newer.tasks[ident]
+		switch {
+		case !isOK:
+			fmt.Fprintf(out, "- task %s (%s, %s)\n", ident, was.deployID, was.status)
+		case !wasOK:
+			fmt.Fprintf(out, "+ task %s (%s, %s)\n", ident, is.deployID, is.status)
+		default:
+			if was.status != is.status {
+				fmt.Fprintf(out, "~ task %s status: %s -> %s\n", ident, was.status, is.status)
+			}
+			diffEnv(out, ident, was.env, is.env)
+		}
+	}
+	return nil
+}
+
+// captureSingularity is the ID of the Singularity whose captures of the
+// request requestID to diff: the one at url, or if url is empty, the only one
+// with captures of it.
+func (db *database) captureSingularity(requestID, url string) (int64, error) {
+	rows, err := db.db.Query(`select s.singularity_id, s.url from singularity s
+		where exists (select 1 from req r where r.singularity_id = s.singularity_id and r.request_ident = $1)
+		order by s.url`, requestID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var urls []string
+	for rows.Next() {
+		var id int64
+		var singURL string
+		if err := rows.Scan(&id, &singURL); err != nil {
+			return 0, err
+		}
+		if url != "" && singURL == url {
+			return id, nil
+		}
+		ids = append(ids, id)
+		urls = append(urls, singURL)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case url != "":
+		return 0, fmt.Errorf("no captures of %q from %s", requestID, url)
+	case len(ids) == 0:
+		return 0, fmt.Errorf("no captures of %q", requestID)
+	case len(ids) > 1:
+		return 0, fmt.Errorf("%q was captured from several Singularities (%s): pass the <url> to diff", requestID, strings.Join(urls, ", "))
+	}
+	return ids[0], nil
+}
+
+func diffEnv(out io.Writer, ident string, was, is map[string]string) {
+	names := []string{}
+	for name := range was {
+		names = append(names, name)
+	}
+	for name := range is {
+		if _, have := was[name]; !have {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldVal, oldOK := was[name]
+		newVal, newOK := is[name]
+		switch {
+		case !newOK:
+			fmt.Fprintf(out, "- task %s env %s=%q\n", ident, name, oldVal)
+		case !oldOK:
+			fmt.Fprintf(out, "+ task %s env %s=%q\n", ident, name, newVal)
+		case oldVal != newVal:
+			fmt.Fprintf(out, "~ task %s env %s: %q -> %q\n", ident, name, oldVal, newVal)
+		}
+	}
+}
+
+func taskIdents(captures ...*capture) []string {
+	seen := map[string]struct{}{}
+	idents := []string{}
+	for _, c := range captures {
+		for ident := range c.tasks {
+			if _, have := seen[ident]; !have {
+				seen[ident] = struct{}{}
+				idents = append(idents, ident)
+			}
+		}
+	}
+	sort.Strings(idents)
+	return idents
+}
+
+func (db *database) loadCapture(reqID int64, capturedAt time.Time) (*capture, error) {
+	c := &capture{capturedAt: capturedAt, tasks: map[string]*capturedTask{}}
+	byID := map[int64]*capturedTask{}
+
+	rows, err := db.db.Query("select task_id, task_ident, deploy_ident, status from task where req_id = $1", reqID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var ident string
+		t := &capturedTask{env: map[string]string{}}
+		if err := rows.Scan(&id, &ident, &t.deployID, &t.status); err != nil {
+			return nil, err
+		}
+		c.tasks[ident] = t
+		byID[id] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	envRows, err := db.db.Query("select env.task_id, name, value from env join task using (task_id) where req_id = $1", reqID)
+	if err != nil {
+		return nil, err
+	}
+	defer envRows.Close()
+	for envRows.Next() {
+		var id int64
+		var name, value string
+		if err := envRows.Scan(&id, &name, &value); err != nil {
+			return nil, err
+		}
+		if t, ok := byID[id]; ok {
+			t.env[name] = value
+		}
+	}
+	return c, envRows.Err()
+}
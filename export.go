@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// exportedTask is one task of the database, joined with its request and
+// Singularity.
+type exportedTask struct {
+	URL          string            `json:"url"`
+	RequestID    string            `json:"requestId"`
+	Instances    int64             `json:"instances"`
+	RequestType  string            `json:"requestType"`
+	RequestState string            `json:"requestState"`
+	CapturedAt   time.Time         `json:"capturedAt"`
+	RunID        string            `json:"runId,omitempty"`
+	TaskID       string            `json:"taskId"`
+	DeployID     string            `json:"deployId"`
+	Status       string            `json:"status"`
+	DockerImage  string            `json:"dockerImage,omitempty"`
+	Env          map[string]string `json:"env"`
+}
+
+var exportHeaders = []string{
+	"url", "request_id", "instances", "request_type", "request_state", "captured_at",
+	"task_id", "deploy_id", "status", "docker_image", "env", "run_id",
+}
+
+// exportDB writes every task recorded in the database to out, as CSV or
+// NDJSON, or only those of the scan run with ID run if it isn't empty. In
+// CSV, each task's environment is a JSON object in the env column.
+func exportDB(db *database, format, run string, out io.Writer) error {
+	tasks, err := db.exportedTasks(run)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	default:
+		return fmt.Errorf("can't export as %q", format)
+	case "ndjson":
+		enc := json.NewEncoder(out)
+		for _, t := range tasks {
+			if err := enc.Encode(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		w := csv.NewWriter(out)
+		if err := w.Write(exportHeaders); err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			env, err := json.Marshal(t.Env)
+			if err != nil {
+				return err
+			}
+			if err := w.Write([]string{
+				t.URL, t.RequestID, strconv.FormatInt(t.Instances, 10), t.RequestType, t.RequestState,
+				t.CapturedAt.Format(time.RFC3339), t.TaskID, t.DeployID, t.Status, t.DockerImage, string(env), t.RunID,
+			}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+}
+
+func (db *database) exportedTasks(run string) ([]*exportedTask, error) {
+	envs, err := db.allEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.Query(`select s.url, r.request_ident, r.instances, r.type, r.state, r.captured_at,
+		coalesce(ru.run_ident, ''), t.task_id, t.task_ident, t.deploy_ident, t.status, coalesce(d.image_name, '')
+		from task t
+		join req r on r.req_id = t.req_id
+		join singularity s on s.singularity_id = r.singularity_id
+		left join run ru on ru.run_id = r.run_id
+		left join docker_image d on d.task_id = t.task_id
+		where $1 = '' or ru.run_ident = $1
+		order by r.captured_at, r.request_ident, t.task_ident`, run)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []*exportedTask{}
+	for rows.Next() {
+		var id int64
+		t := &exportedTask{}
+		if err := rows.Scan(&t.URL, &t.RequestID, &t.Instances, &t.RequestType, &t.RequestState, &t.CapturedAt,
+			&t.RunID, &id, &t.TaskID, &t.DeployID, &t.Status, &t.DockerImage); err != nil {
+			return nil, err
+		}
+		t.Env = envs[id]
+		if t.Env == nil {
+			t.Env = map[string]string{}
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+func (db *database) allEnv() (map[int64]map[string]string, error) {
+	rows, err := db.db.Query("select task_id, name, value from env")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envs := map[int64]map[string]string{}
+	for rows.Next() {
+		var id int64
+		var name, value string
+		if err := rows.Scan(&id, &name, &value); err != nil {
+			return nil, err
+		}
+		if envs[id] == nil {
+			envs[id] = map[string]string{}
+		}
+		envs[id][name] = value
+	}
+	return envs, rows.Err()
+}
+
+// sameFile is true if the paths a and b lead to the same file, or would once
+// it is made.
+func sameFile(a, b string) bool {
+	aInfo, aErr := os.Stat(a)
+	bInfo, bErr := os.Stat(b)
+	if aErr == nil && bErr == nil {
+		return os.SameFile(aInfo, bInfo)
+	}
+	aAbs, aErr := filepath.Abs(a)
+	bAbs, bErr := filepath.Abs(b)
+	return aErr == nil && bErr == nil && aAbs == bAbs
+}
+
+// writeSqlite copies the tasks of the scan run with ID run to a new database
+// at path, replacing any file there, so that the capture can be handed on
+// without the rest of the working database.
+func writeSqlite(db *database, run, path string) error {
+	if sameFile(db.path, path) {
+		return fmt.Errorf("%s is the --db-path database itself; refusing to replace it", path)
+	}
+	tasks, err := db.exportedTasks(run)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := tryDB(path, false)
+	if err != nil {
+		return err
+	}
+	defer out.close()
+
+	if err := out.addRun(run); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		if err := out.addRecord(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	singularity "github.com/opentable/go-singularity"
+)
+
+// fakeSingularity serves the canned responses under testdata/singularity,
+// so that GET /api/requests answers with testdata/singularity/api/requests.json.
+// Paths without a file get a 404, as unknown tasks do from Singularity.
+func fakeSingularity(t *testing.T) *httptest.Server {
+	root := filepath.Join("testdata", "singularity")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := filepath.Join(root, filepath.FromSlash(path.Clean(r.URL.Path))+".json")
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fakeClient starts a fakeSingularity and returns a client for it, along
+// with its URL.
+func fakeClient(t *testing.T, opts *options) (*singularity.Client, string) {
+	srv := fakeSingularity(t)
+	client, err := newClient(opts, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv.URL
+}
+
+// scanFake scans a fakeSingularity with the options parsed from args, and
+// returns the task lines it produced, ordered by task ID.
+func scanFake(t *testing.T, args ...string) (*options, []*taskDesc) {
+	srv := fakeSingularity(t)
+	opts := parseArgs(append(args, srv.URL))
+
+	client, err := newClient(opts, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tasks := []*taskDesc{}
+	scanSingularity(context.Background(), opts, srv.URL, client, map[string]struct{}{}, func(td *taskDesc) {
+		tasks = append(tasks, td)
+	})
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].SingularityTaskId.Id < tasks[j].SingularityTaskId.Id
+	})
+	return opts, tasks
+}
+
+// scanFakes is scanFake across two fakeSingularities, which have the same
+// requests, as clusters deployed alike do. Their tasks share IDs too, so
+// each is scanned without regard to the other's; the tasks are ordered by
+// URL, then task ID.
+func scanFakes(t *testing.T, args ...string) (*options, []*taskDesc) {
+	srvs := []*httptest.Server{fakeSingularity(t), fakeSingularity(t)}
+	opts := parseArgs(append(args, srvs[0].URL, srvs[1].URL))
+
+	tasks := []*taskDesc{}
+	for _, srv := range srvs {
+		client, err := newClient(opts, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanSingularity(context.Background(), opts, srv.URL, client, map[string]struct{}{}, func(td *taskDesc) {
+			tasks = append(tasks, td)
+		})
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].URL != tasks[j].URL {
+			return tasks[i].URL < tasks[j].URL
+		}
+		return tasks[i].SingularityTaskId.Id < tasks[j].SingularityTaskId.Id
+	})
+	return opts, tasks
+}
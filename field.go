@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// fieldPath is a --field: a path into the Singularity data about a task, in
+// the JSON shape Singularity sends it, and the name of its column.
+type fieldPath struct {
+	name  string
+	steps []interface{} // object keys as strings, array indexes as ints
+}
+
+// fieldRoots are the top-level names a --field path starts from.
+var fieldRoots = []string{"task", "taskId", "request", "lastUpdate", "docker", "usage", "healthchecks", "updates", "deployResult"}
+
+// parseField parses a --field spec: a path like task.mesosTask.resources[0].name,
+// optionally written JSONPath style with a leading "$." and bracketed keys,
+// and optionally preceded by "NAME=" to name its column.
+func parseField(spec string) (fieldPath, error) {
+	fp := fieldPath{name: spec}
+	path := spec
+	if eq := strings.Index(spec, "="); eq > 0 && !strings.ContainsAny(spec[:eq], ".[$") {
+		fp.name, path = spec[:eq], spec[eq+1:]
+	}
+	path = strings.TrimPrefix(path, "$")
+	path = strings.TrimPrefix(path, ".")
+
+	for path != "" {
+		switch {
+		case strings.HasPrefix(path, "['") || strings.HasPrefix(path, `["`):
+			end := strings.Index(path[2:], path[1:2]+"]")
+			if end < 0 {
+				return fp, fmt.Errorf("bad --field %q: unterminated key", spec)
+			}
+			fp.steps = append(fp.steps, path[2:2+end])
+			path = path[2+end+2:]
+		case strings.HasPrefix(path, "["):
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return fp, fmt.Errorf("bad --field %q: unterminated index", spec)
+			}
+			n, err := strconv.Atoi(path[1:end])
+			if err != nil || n < 0 {
+				return fp, fmt.Errorf("bad --field %q: index %q isn't a number", spec, path[1:end])
+			}
+			fp.steps = append(fp.steps, n)
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			if end == 0 {
+				return fp, fmt.Errorf("bad --field %q: empty key", spec)
+			}
+			fp.steps = append(fp.steps, path[:end])
+			path = path[end:]
+		}
+		if strings.HasPrefix(path, ".") {
+			path = path[1:]
+			if path == "" {
+				return fp, fmt.Errorf("bad --field %q: trailing '.'", spec)
+			}
+		}
+	}
+
+	if len(fp.steps) == 0 {
+		return fp, fmt.Errorf("bad --field %q: empty path", spec)
+	}
+	root, ok := fp.steps[0].(string)
+	if !ok || !validFieldRoot(root) {
+		return fp, fmt.Errorf("bad --field %q: paths start with one of: %s", spec, strings.Join(fieldRoots, ", "))
+	}
+	return fp, nil
+}
+
+func validFieldRoot(name string) bool {
+	for _, root := range fieldRoots {
+		if root == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldData is the Singularity data about td, as plain maps and slices to
+// walk a fieldPath through.
+func (td *taskDesc) fieldData() map[string]interface{} {
+	return map[string]interface{}{
+		"task":         plainValue(reflect.ValueOf(td.SingularityTask)),
+		"taskId":       plainValue(reflect.ValueOf(td.SingularityTaskId)),
+		"request":      plainValue(reflect.ValueOf(td.SingularityRequestParent)),
+		"lastUpdate":   plainValue(reflect.ValueOf(td.SingularityTaskHistoryUpdate)),
+		"docker":       plainValue(reflect.ValueOf(td.DockerInfo)),
+		"usage":        plainValue(reflect.ValueOf(td.Usage)),
+		"healthchecks": plainValue(reflect.ValueOf(td.Healthchecks)),
+		"updates":      plainValue(reflect.ValueOf(td.Updates)),
+		"deployResult": plainValue(reflect.ValueOf(td.DeployResult)),
+	}
+}
+
+// plainValue converts v to the maps, slices and scalars decoding its JSON
+// would give, leaving out nil and omitempty fields. The DTOs only marshal
+// the fields they were populated through, which those decoded from
+// Singularity's responses weren't, so they can't simply be marshaled.
+func plainValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return plainValue(v.Elem())
+	case reflect.Struct:
+		obj := map[string]interface{}{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" || len(tag) > 1 && tag[1] == "omitempty" && v.Field(i).IsZero() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if fv := plainValue(v.Field(i)); fv != nil {
+				obj[name] = fv
+			}
+		}
+		return obj
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = plainValue(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		obj := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			obj[fmt.Sprint(k.Interface())] = plainValue(v.MapIndex(k))
+		}
+		return obj
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return nil
+}
+
+// lookup walks fp through data, and is false if the path leads nowhere.
+func (fp fieldPath) lookup(data map[string]interface{}) (interface{}, bool) {
+	var at interface{} = data
+	for _, step := range fp.steps {
+		switch s := step.(type) {
+		case string:
+			obj, ok := at.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if at, ok = obj[s]; !ok {
+				return nil, false
+			}
+		case int:
+			list, ok := at.([]interface{})
+			if !ok || s >= len(list) {
+				return nil, false
+			}
+			at = list[s]
+		}
+	}
+	return at, at != nil
+}
+
+// value is fp's value for td, for a record.
+func (fp fieldPath) value(td *taskDesc) interface{} {
+	v, _ := fp.lookup(td.fieldData())
+	return v
+}
+
+// fieldString formats a --field value for a column: strings as they are,
+// anything else as JSON, and nothing as the empty string.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	text, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(text)
+}
+
+func fieldColumn(fp fieldPath) column {
+	return column{fp.name, func(td *taskDesc) string { return fieldString(fp.value(td)) }}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestField(t *testing.T) {
+	_, tasks := scanFake(t, "--request-id=team-web")
+	var td *taskDesc
+	for _, task := range tasks {
+		if task.SingularityTaskId.Id == "team-web-d2-1" {
+			td = task
+		}
+	}
+	if td == nil {
+		t.Fatal("no task team-web-d2-1")
+	}
+
+	cases := []struct {
+		spec, name, want string
+	}{
+		{"task.mesosTask.container.docker.image", "task.mesosTask.container.docker.image", "registry.example.com/web:2"},
+		{"$.task.taskId.instanceNo", "$.task.taskId.instanceNo", "1"},
+		{"code=healthchecks[0]['statusCode']", "code", "200"},
+		{"task.mesosTask.slaveId.value", "task.mesosTask.slaveId.value", "agent-1"},
+		{"task.taskRequest.deploy.containerInfo", "task.taskRequest.deploy.containerInfo", ""},
+		{"healthchecks[0]", "healthchecks[0]", `{"durationMillis":0,"statusCode":200,"timestamp":7000}`},
+		{"healthchecks[3].statusCode", "healthchecks[3].statusCode", ""},
+		{"task.nothing.here", "task.nothing.here", ""},
+	}
+	for _, c := range cases {
+		fp, err := parseField(c.spec)
+		if err != nil {
+			t.Errorf("parseField(%q): %v", c.spec, err)
+			continue
+		}
+		col := fieldColumn(fp)
+		if col.header != c.name {
+			t.Errorf("--field=%s is named %q, want %q", c.spec, col.header, c.name)
+		}
+		if got := col.value(td); got != c.want {
+			t.Errorf("--field=%s is %q, want %q", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestParseFieldErrors(t *testing.T) {
+	for _, spec := range []string{"", "$", "bogus.id", "task..id", "task.", "task[x]", "task['id", "[0]"} {
+		if _, err := parseField(spec); err == nil {
+			t.Errorf("parseField(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "strings"
+
+// defaultRegistry is the registry docker pulls images from when their name
+// doesn't give one.
+const defaultRegistry = "docker.io"
+
+// imageRegistry is the registry host of a docker image reference. As docker
+// reads them, the first component of the name is a registry only if it looks
+// like a host: it has a "." or a port, or is "localhost".
+func imageRegistry(image string) string {
+	slash := strings.Index(image, "/")
+	if slash < 0 {
+		return defaultRegistry
+	}
+	host := image[:slash]
+	if host == "localhost" || strings.ContainsAny(host, ".:") {
+		return host
+	}
+	return defaultRegistry
+}
+
+// registry is the registry the task's docker image comes from, or "" for
+// tasks without docker.
+func (td *taskDesc) registry() string {
+	if td.DockerInfo == nil || td.DockerInfo.Image == "" {
+		return ""
+	}
+	return imageRegistry(td.DockerInfo.Image)
+}
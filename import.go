@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// importDB records each line of in, an NDJSON task as written by
+// "cygnus export --format=ndjson" or --format=ndjson, in the database. Lines
+// that aren't valid tasks are reported and skipped. It returns the number of
+// tasks imported, and of lines skipped.
+func importDB(db *database, in io.Reader, name string) (imported, skipped int, err error) {
+	lines := bufio.NewScanner(in)
+	lines.Buffer(nil, 16*1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		if len(lines.Bytes()) == 0 {
+			continue
+		}
+		rec, err := parseImported(lines.Bytes(), db.now)
+		if err == nil {
+			err = db.addRecord(rec)
+		}
+		if err != nil {
+			log.Printf("%s:%d: %v", name, n, err)
+			skipped++
+			continue
+		}
+		imported++
+	}
+	return imported, skipped, lines.Err()
+}
+
+// parseImported reads a task record, filling in what records from a scan
+// don't have: they are taken to be captured now, from an unknown Singularity.
+func parseImported(line []byte, now time.Time) (*exportedTask, error) {
+	rec := &exportedTask{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		return nil, err
+	}
+	if rec.RequestID == "" || rec.TaskID == "" {
+		return nil, fmt.Errorf("missing requestId or taskId")
+	}
+
+	if rec.URL == "" {
+		rec.URL = "unknown"
+	}
+	if rec.CapturedAt.IsZero() {
+		rec.CapturedAt = now
+	}
+	for _, field := range []*string{&rec.RequestType, &rec.RequestState, &rec.Status} {
+		if *field == "" {
+			*field = "UNKNOWN"
+		}
+	}
+	if rec.Env == nil {
+		rec.Env = map[string]string{}
+	}
+	return rec, nil
+}
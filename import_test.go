@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportSkipsBadLines(t *testing.T) {
+	db, err := newDB(filepath.Join(t.TempDir(), "cygnus.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	in := strings.Join([]string{
+		`{"url":"http://sing","requestId":"web","instances":2,"requestType":"SERVICE","requestState":"ACTIVE","capturedAt":"2020-01-02T03:04:05Z","taskId":"web-1","deployId":"d1","status":"TASK_RUNNING","env":{"PORT0":"31000"}}`,
+		`{"requestId":"web","taskId":"web-2"}`,
+		`not json`,
+		`{"requestId":"web"}`,
+	}, "\n")
+
+	imported, skipped, err := importDB(db, strings.NewReader(in), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 || skipped != 2 {
+		t.Errorf("imported %d, skipped %d; want 2 and 2", imported, skipped)
+	}
+
+	tasks, err := db.exportedTasks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(tasks))
+	}
+	for _, task := range tasks {
+		switch task.TaskID {
+		case "web-1":
+			if task.Env["PORT0"] != "31000" || task.Instances != 2 {
+				t.Errorf("web-1 recorded as %+v", task)
+			}
+		case "web-2":
+			if task.URL != "unknown" || task.Status != "UNKNOWN" {
+				t.Errorf("web-2 recorded without defaults: %+v", task)
+			}
+		default:
+			t.Errorf("unexpected task %q", task.TaskID)
+		}
+	}
+}
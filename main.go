@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
-	"sync"
-	"text/tabwriter"
+	"sync/atomic"
+	"time"
 
+	"github.com/nyarly/cygnus/scanner"
 	singularity "github.com/opentable/go-singularity"
 	dtos "github.com/opentable/go-singularity/dtos"
+	"github.com/opentable/swaggering"
 )
 
 var debugLog = log.New(ioutil.Discard, "", 0)
@@ -19,12 +25,7 @@ func debug(fmt string, vars ...interface{}) {
 }
 
 type taskDesc struct {
-	*dtos.SingularityTaskId
-	*dtos.SingularityTask
-	*dtos.SingularityRequestParent
-	*dtos.SingularityTaskHistoryUpdate
-	*dtos.DockerInfo
-	url string
+	scanner.TaskRecord
 }
 
 func main() {
@@ -34,232 +35,780 @@ func main() {
 		debugLog.SetFlags(log.Lshortfile | log.Ltime)
 	}
 
-	client := singularity.NewClient(opts.URL)
+	if opts.Diff {
+		database, err := readDB(opts.dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer database.close()
+		if len(opts.url) > 1 {
+			log.Fatal("diff compares the captures of one Singularity: pass at most one <url>")
+		}
+		url := ""
+		if len(opts.url) == 1 {
+			url = opts.url[0]
+		}
+		if err := diffCaptures(database, opts.reqId, url, opts.run, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.Export {
+		database, err := readDB(opts.dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer database.close()
+		dest, closeDest, err := openDestination(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := exportDB(database, opts.format, opts.run, dest); err != nil {
+			log.Fatal(err)
+		}
+		if err := closeDest(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.DbInfo {
+		info, err := readDBInfo(opts.dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printDBInfo(info, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.Task {
+		showTask(opts, opts.taskId)
+		return
+	}
+
+	if opts.CompareEnv {
+		compareTaskEnvs(opts, opts.taskA, opts.taskB)
+		return
+	}
+
+	if opts.Import {
+		database, err := newDB(opts.dbPath, opts.append)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer database.close()
+		if _, err := database.startRun(); err != nil {
+			log.Fatal(err)
+		}
+		in := os.Stdin
+		if opts.file != "-" {
+			if in, err = os.Open(opts.file); err != nil {
+				log.Fatal(err)
+			}
+			defer in.Close()
+		}
+		imported, skipped, err := importDB(database, in, opts.file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Imported %d tasks, skipped %d lines", imported, skipped)
+		return
+	}
 
-	debug("Getting all requests")
-	reqList, err := client.GetRequests()
+	dest, closeDest, err := openDestination(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	debug("reqList count: %d", len(reqList))
-
-	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	out := newOutput(opts, dest)
 
 	if opts.printHeaders {
-		writer.Write([]byte(strings.Join(append([]string{`Request ID`, `Deploy ID`}, headerNames(opts)...), "\t")))
-		writer.Write([]byte{'\n'})
+		out.header(opts)
 	}
 
-	lines := make(chan *taskDesc, 20)
-	wait := new(sync.WaitGroup)
-
-	database := newDB()
+	database, err := newDB(opts.dbPath, opts.append)
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer database.close()
+	run, err := database.startRun()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go tabRows(writer, wait, opts, database, lines)
+	dbTasks := make(chan *taskDesc, 20)
+	dbDone := make(chan struct{})
+	go database.writeTasks(dbTasks, dbDone)
+
+	seenEnv := map[string]struct{}{}
+	printedReqs := map[string]struct{}{}
+	running := 0
+	fetched, fetchTime := 0, time.Duration(0)
+	handle := func(td *taskDesc) {
+		fetched++
+		fetchTime += td.FetchTime
+		tabRow(out, opts, dbTasks, seenEnv, printedReqs, td)
+		if printable(td, opts) && td.status() == string(dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING) {
+			running++
+		}
+	}
 
 	seen := map[string]struct{}{}
-
-	for n, req := range reqList {
-		debug("req %d: %#v", n, req)
-		if opts.printInactiveTasks {
-			histo, _ := client.GetTaskHistoryForRequest(req.Request.Id, 10, 1)
-			seen = getTasks(opts.URL, client, histo, lines, reqList, seen, wait)
+	scanned := dtos.SingularityRequestParentList{}
+	empty := []*taskDesc{}
+
+	// Each Singularity gets one client, and with it one pool of connections,
+	// however many times it is scanned.
+	clients := map[string]*singularity.Client{}
+	for _, url := range opts.url {
+		client, err := newClient(opts, url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clients[url] = client
+		if !opts.noPreflight {
+			if err := preflight(client, url); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if opts.clusterInfo {
+			info, err := clusterInfo(client, url)
+			if err != nil {
+				debug("No cluster information from %s: %v", url, err)
+				continue
+			}
+			fmt.Fprintln(os.Stderr, info)
 		}
+	}
 
-		histo, _ := client.GetTaskHistoryForActiveRequest(req.Request.Id)
-		seen = getTasks(opts.URL, client, histo, lines, reqList, seen, wait)
+	start := time.Now()
+	if opts.timeout > 0 {
+		opts.deadline = start.Add(opts.timeout)
+	}
+	cut := 0
+	for _, url := range opts.url {
+		reqs, cutShort := scanSingularity(context.Background(), opts, url, clients[url], seen, handle)
+		scanned = append(scanned, reqs...)
+		for _, req := range reqs {
+			empty = append(empty, emptyRequest(url, req))
+		}
+		cut += cutShort
 	}
 
-	wait.Wait()
-	writer.Flush()
-}
+	close(dbTasks)
+	<-dbDone
 
-func getTasks(url string, client *singularity.Client, histo dtos.SingularityTaskIdHistoryList, lines chan *taskDesc, reqList dtos.SingularityRequestParentList, seen map[string]struct{}, wait *sync.WaitGroup) map[string]struct{} {
-	for _, hist := range histo {
-		if _, have := seen[hist.TaskId.Id]; have {
-			continue
+	if opts.sqliteOut != "" {
+		if err := writeSqlite(database, run, opts.sqliteOut); err != nil {
+			log.Fatalf("Writing %s: %v", opts.sqliteOut, err)
 		}
-		seen[hist.TaskId.Id] = struct{}{}
+	}
 
-		wait.Add(1)
-		debug("Starting line for %#v", hist.TaskId)
-		go getTask(url, hist.TaskId, reqList, client, wait, lines)
+	if opts.showEmpty {
+		printEmpty(out, opts, clients, empty, printedReqs)
+	}
+	out.flush()
+	if err := closeDest(); err != nil {
+		log.Fatal(err)
 	}
-	return seen
-}
 
-func getTask(url string, id *dtos.SingularityTaskId, reqs dtos.SingularityRequestParentList, client *singularity.Client, wait *sync.WaitGroup, lines chan *taskDesc) {
-	var task *dtos.SingularityTask
-	if id == nil {
-		log.Printf("Missing ID for task %#v", task)
-		wait.Add(-1)
-		return
+	if opts.warnUnknownEnv {
+		warnUnknownEnv(opts, seenEnv)
+	}
+	if cut > 0 {
+		log.Printf("Warning: output truncated: %d of %d requests scanned in full before the --timeout", len(scanned)-cut, len(scanned))
 	}
 
-	var err error
+	if opts.timing {
+		reportTiming(time.Since(start), len(scanned), fetched, fetchTime)
+	}
 
-	var taskHistory *dtos.SingularityTaskHistory
-	var lastUpdate *dtos.SingularityTaskHistoryUpdate
-	var dockerInfo *dtos.DockerInfo
+	if opts.expectRunningSet && running != opts.expectRunning {
+		log.Fatalf("Expected %d running tasks, found %d", opts.expectRunning, running)
+	}
+}
 
-	for i := 0; i < 3; i++ {
-		debug("Getting history: %v", id.Id)
-		taskHistory, err = client.GetHistoryForTask(id.Id)
-		debug("taskHistory: %#v", taskHistory)
-		if len(taskHistory.TaskUpdates) > 0 {
-			lastUpdate = taskHistory.TaskUpdates[0]
+// scanSingularity hands each task of the selected requests at url to handle,
+// and returns the requests it scanned, and how many of those --timeout cut
+// short.
+func scanSingularity(ctx context.Context, opts *options, url string, client *singularity.Client, seen map[string]struct{}, handle func(*taskDesc)) (dtos.SingularityRequestParentList, int) {
+	var reqList dtos.SingularityRequestParentList
+	var err error
+	if len(opts.requestId) > 0 {
+		reqList = getNamedRequests(client, url, opts.requestId)
+	} else {
+		debug("Getting all requests from %s", url)
+		reqList, err = getRequests(client, url, opts.cacheRequests)
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
+	debug("reqList count: %d", len(reqList))
 
-		if err == nil {
-			task = taskHistory.Task
-			break
+	if opts.Select {
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			log.Fatal("--select requires an interactive terminal")
+		}
+		reqList, err = selectRequests(reqList, os.Stdin, os.Stderr)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	if err != nil {
-		log.Print(err)
-		wait.Add(-1)
-		return
+
+	scanned := dtos.SingularityRequestParentList{}
+	for _, req := range reqList {
+		if requestSelected(req, opts) {
+			scanned = append(scanned, req)
+		}
 	}
 
-	for _, upd := range taskHistory.TaskUpdates {
-		if upd.Timestamp > lastUpdate.Timestamp {
-			lastUpdate = upd
+	tasks, errs := scanner.Scan(ctx, scanner.Options{
+		URL:              url,
+		Client:           client,
+		Requests:         scanned,
+		Scope:            opts.scope,
+		Seen:             seen,
+		NoDedup:          opts.noDedup,
+		Usage:            opts.printUsage,
+		DeployResults:    opts.printDeployState,
+		RequestHistory:   opts.flapHistory,
+		ParallelRequests: opts.parallelRequests,
+		Deadline:         opts.deadline,
+		Limiter:          opts.taskLimiter,
+		NoDocker:         opts.noDocker,
+		Debug:            debugLog,
+	})
+	cut := map[string]struct{}{}
+	for tasks != nil || errs != nil {
+		select {
+		case rec, ok := <-tasks:
+			if !ok {
+				tasks = nil
+				continue
+			}
+			handle(&taskDesc{rec})
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Print(err)
+			if serr, is := err.(*scanner.Error); is && serr.Err == scanner.ErrDeadline {
+				cut[serr.RequestID] = struct{}{}
+			}
 		}
 	}
-	debug("last update: %#v", lastUpdate)
-	debug("task request: %#v", task)
+	return scanned, len(cut)
+}
+
+// getNamedRequests fetches each of the requests ids from the Singularity at
+// url, reporting those it can't find.
+func getNamedRequests(client *singularity.Client, url string, ids []string) dtos.SingularityRequestParentList {
+	reqList := dtos.SingularityRequestParentList{}
+	for _, id := range ids {
+		debug("Getting request %s from %s", id, url)
+		req, err := client.GetRequest(id)
+		if rerr, is := err.(*swaggering.ReqError); is && rerr.Status == http.StatusNotFound {
+			log.Printf("Unknown request %s at %s", id, url)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error getting request %s from %s: %v", id, url, err)
+			continue
+		}
+		reqList = append(reqList, req)
+	}
+	return reqList
+}
+
+// emptyRequest is a placeholder line for a request that had no tasks to show.
+func emptyRequest(url string, req *dtos.SingularityRequestParent) *taskDesc {
+	return &taskDesc{scanner.TaskRecord{
+		SingularityTaskId:        &dtos.SingularityTaskId{RequestId: req.Request.Id},
+		SingularityRequestParent: req,
+		URL:                      url,
+	}}
+}
+
+// requestKey identifies the task's request: request IDs are only unique
+// within one Singularity.
+func (td *taskDesc) requestKey() string {
+	return td.URL + " " + td.SingularityTaskId.RequestId
+}
+
+// multiSingularity is true when more than one Singularity is scanned, so
+// that output by request must say which Singularity each request is at.
+func (opts *options) multiSingularity() bool {
+	return len(opts.url) > 1
+}
+
+// placeholder is true of the lines made by emptyRequest.
+func (td *taskDesc) placeholder() bool {
+	return td.SingularityTask == nil
+}
 
-	mesos := task.MesosTask
+func (td *taskDesc) Env() *dtos.Environment {
+	if td.placeholder() {
+		return nil
+	}
+	mesos := td.SingularityTask.MesosTask
 	if mesos == nil {
-		log.Printf("Missing mesos task info for %#v", task)
-		wait.Add(-1)
-		return
+		return nil
 	}
-	debug("mesos task info %#v", mesos)
-	debug("mesos task info container %#v", mesos.Container)
-	debug("mesos task info docker %#v", mesos.Container.Docker)
 
 	cmd := mesos.Command
 	if cmd == nil {
-		log.Printf("No command for task %#v", mesos)
-		wait.Add(-1)
-		return
+		return nil
 	}
-	env := cmd.Environment
+	return cmd.Environment
+}
+
+func (td *taskDesc) agentID() string {
+	mesos := td.SingularityTask.MesosTask
+	if mesos == nil || mesos.SlaveId == nil {
+		return ""
+	}
+	return mesos.SlaveId.Value
+}
+
+func (td *taskDesc) envVar(name string) string {
+	env := td.Env()
 	if env == nil {
-		log.Printf("No enviroment for task %#v / %#v", mesos, cmd)
-		wait.Add(-1)
-		return
+		return ""
+	}
+	for _, v := range env.Variables {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// missingEnv lists the --require-env variables td doesn't set.
+func (td *taskDesc) missingEnv(opts *options) []string {
+	set := map[string]struct{}{}
+	if env := td.Env(); env != nil {
+		for _, v := range env.Variables {
+			set[v.Name] = struct{}{}
+		}
 	}
+	missing := []string{}
+	for _, name := range opts.requireEnv {
+		if _, ok := set[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
 
-	c := mesos.Container
-	if c != nil {
-		dockerInfo = c.Docker
+func (td *taskDesc) status() string {
+	if td.SingularityTaskHistoryUpdate == nil {
+		return "UNKNOWN"
 	}
+	return string(td.SingularityTaskHistoryUpdate.TaskState)
+}
 
-	var taskReq *dtos.SingularityRequestParent
+// message is the status message of the task's latest update, falling back
+// to the status reason when there's no message.
+func (td *taskDesc) message() string {
+	upd := td.SingularityTaskHistoryUpdate
+	if upd == nil {
+		return ""
+	}
+	if upd.StatusMessage != "" {
+		return upd.StatusMessage
+	}
+	return upd.StatusReason
+}
 
-	for _, req := range reqs {
-		if req.Request.Id == id.RequestId {
-			taskReq = req
-			break
+// updates are the task's state changes, oldest first.
+func (td *taskDesc) updates() []TaskUpdate {
+	updates := []TaskUpdate{}
+	for _, upd := range td.Updates {
+		message := upd.StatusMessage
+		if message == "" {
+			message = upd.StatusReason
 		}
+		updates = append(updates, TaskUpdate{
+			Time:    time.Unix(0, upd.Timestamp*int64(time.Millisecond)).UTC(),
+			State:   string(upd.TaskState),
+			Message: message,
+		})
 	}
+	sort.SliceStable(updates, func(i, j int) bool { return updates[i].Time.Before(updates[j].Time) })
+	return updates
+}
 
-	lines <- &taskDesc{id, task, taskReq, lastUpdate, dockerInfo, url}
+// rack is the rack Singularity placed the task on, taken from the rack
+// attribute of the agent's offer. The vendored client doesn't decode the
+// offer's other attributes, such as availability zones.
+func (td *taskDesc) rack() string {
+	if td.SingularityTask != nil && td.SingularityTask.RackId != "" {
+		return td.SingularityTask.RackId
+	}
+	return td.SingularityTaskId.RackId
 }
 
-func (td *taskDesc) Env() *dtos.Environment {
+// containerType is the type of the task's mesos container, DOCKER or MESOS,
+// or "none" for tasks without one. The vendored Singularity client doesn't
+// decode the MESOS containerizer's image, so its type is all there is to
+// report.
+func (td *taskDesc) containerType() string {
 	mesos := td.SingularityTask.MesosTask
-	if mesos == nil {
-		return nil
+	if mesos == nil || mesos.Container == nil {
+		return "none"
 	}
+	return string(mesos.Container.Type)
+}
 
-	cmd := mesos.Command
-	if cmd == nil {
-		return nil
+// schedule is the cron schedule of a SCHEDULED request, as Singularity
+// runs it: the Quartz form if it has one.
+func (td *taskDesc) schedule() string {
+	req := td.SingularityRequestParent
+	if req == nil || req.Request == nil || req.Request.RequestType != dtos.SingularityRequestRequestTypeSCHEDULED {
+		return ""
 	}
-	return cmd.Environment
+	if req.Request.QuartzSchedule != "" {
+		return req.Request.QuartzSchedule
+	}
+	return req.Request.Schedule
+}
+
+// running is true of tasks whose last update is TASK_RUNNING, or that have
+// no updates at all.
+func (td *taskDesc) running() bool {
+	upd := td.SingularityTaskHistoryUpdate
+	return upd == nil || upd.TaskState == dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING
+}
+
+// stopped is true of tasks whose last update is a terminal state: they won't
+// run again. Tasks still starting up or being cleaned up aren't stopped.
+func (td *taskDesc) stopped() bool {
+	upd := td.SingularityTaskHistoryUpdate
+	if upd == nil {
+		return false
+	}
+	switch upd.TaskState {
+	case dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_FINISHED,
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_FAILED,
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_KILLED,
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_LOST,
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_LOST_WHILE_DOWN,
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_ERROR:
+		return true
+	}
+	return false
+}
+
+// lastSeen is the time of a stopped task's last update, when it was last
+// seen running. It is false for tasks that haven't stopped.
+func (td *taskDesc) lastSeen() (time.Time, bool) {
+	if !td.stopped() {
+		return time.Time{}, false
+	}
+	return time.Unix(0, td.SingularityTaskHistoryUpdate.Timestamp*int64(time.Millisecond)).UTC(), true
 }
 
-func (td *taskDesc) rowString(opts *options) string {
-	return strings.Join(append([]string{td.SingularityTaskId.RequestId, td.SingularityTaskId.DeployId}, taskValues(opts, td)...), "\t") + "\n"
+// lastSeenString is how long ago a stopped task was last seen, or "now" for
+// one that hasn't stopped.
+func (td *taskDesc) lastSeenString() string {
+	at, ok := td.lastSeen()
+	if !ok {
+		return "now"
+	}
+	return nowFunc().Sub(at).Round(time.Second).String() + " ago"
 }
 
-func tabRows(writer *tabwriter.Writer, wait *sync.WaitGroup, opts *options, db *database, lines chan *taskDesc) {
-	for {
-		line := <-lines
-		if printable(line, opts) {
-			writer.Write([]byte(line.rowString(opts)))
+// replacements counts the tasks of td's request and deploy that ended within
+// window of now: those that failed or were otherwise replaced. Mesos never
+// restarts a task, so a crashing instance shows as a run of these rather
+// than in the updates of any one task.
+func (td *taskDesc) replacements(window time.Duration) int {
+	since := nowFunc().Add(-window).UnixNano() / int64(time.Millisecond)
+	ended := map[string]struct{}{}
+	for _, hist := range td.RequestHistory {
+		id := hist.TaskId
+		if id == nil || id.Id == td.SingularityTaskId.Id || id.DeployId != td.SingularityTaskId.DeployId || hist.UpdatedAt < since {
+			continue
 		}
-		go func(line *taskDesc) {
-			wait.Add(1)
-			db.addTask(line)
-			wait.Done()
-		}(line)
-		wait.Done()
+		ended[id.Id] = struct{}{}
 	}
+	return len(ended)
 }
 
-func printable(desc *taskDesc, opts *options) bool {
-	debug("printable: %t %v %s", opts.printInactiveTasks,
-		desc.SingularityTaskHistoryUpdate,
-		desc.SingularityTaskHistoryUpdate.TaskState)
-	return opts.printInactiveTasks ||
-		desc.SingularityTaskHistoryUpdate == nil ||
-		desc.SingularityTaskHistoryUpdate.TaskState ==
-			dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING
+// flapping is true of tasks whose request and deploy replaced more than
+// --flap-threshold tasks within the --flap-window.
+func (td *taskDesc) flapping(opts *options) bool {
+	return td.replacements(opts.flapWindow) > opts.flapThreshold
 }
 
-func headerNames(opts *options) []string {
-	headers := []string{}
+// oomReasons are the signs in a task's last update, lowercased, that it was
+// killed for exceeding its memory limit: mesos's reason for it, and the
+// wording of the messages seen alongside.
+var oomReasons = []string{"reason_container_limitation_memory", "memory limit", "out of memory", "oom-kill", "oomkill", "oom kill"}
+
+// oom is true of tasks whose last update says they ran out of memory.
+func (td *taskDesc) oom() bool {
+	upd := td.SingularityTaskHistoryUpdate
+	if upd == nil {
+		return false
+	}
+	text := strings.ToLower(upd.StatusReason + " " + upd.StatusMessage)
+	for _, reason := range oomReasons {
+		if strings.Contains(text, reason) {
+			return true
+		}
+	}
+	return false
+}
 
-	if opts.printPending || opts.printActive {
-		headers = append(headers, "State")
+// health summarizes the task's health checks as healthy, unhealthy or
+// pending. It is blank when the task's deploy has no health check.
+func (td *taskDesc) health() string {
+	var latest *dtos.SingularityTaskHealthcheckResult
+	for _, hc := range td.Healthchecks {
+		if latest == nil || hc.Timestamp > latest.Timestamp {
+			latest = hc
+		}
 	}
-	headers = append(headers, opts.env...)
-	if opts.printStatus {
-		headers = append(headers, "Task Status")
+
+	if latest == nil {
+		tr := td.SingularityTask.TaskRequest
+		if tr == nil || tr.Deploy == nil || tr.Deploy.HealthcheckUri == "" {
+			return ""
+		}
+		return "pending"
 	}
-	if opts.printDockerImage {
-		headers = append(headers, "Docker Image")
+
+	if latest.ErrorMessage == "" && latest.StatusCode >= 200 && latest.StatusCode < 300 {
+		return "healthy"
 	}
-	return headers
+	return "unhealthy"
 }
 
-func taskValues(opts *options, td *taskDesc) []string {
-	vals := []string{}
-	vars := map[string]string{}
+// deployResult is the state of the request's latest deploy, followed by its
+// message if it failed.
+func (td *taskDesc) deployResult() string {
+	if td.DeployResult == nil {
+		return ""
+	}
+	state := string(td.DeployResult.DeployState)
+	if td.DeployResult.DeployState == dtos.SingularityDeployResultDeployStateFAILED && td.DeployResult.Message != "" {
+		return state + ": " + strings.Join(strings.Fields(td.DeployResult.Message), " ")
+	}
+	return state
+}
 
-	env := td.Env()
+// launchLatency is the time from the task's first update to it reaching
+// TASK_RUNNING. It is false for tasks that never ran.
+func (td *taskDesc) launchLatency() (time.Duration, bool) {
+	var first, running int64
+	for _, upd := range td.Updates {
+		if first == 0 || upd.Timestamp < first {
+			first = upd.Timestamp
+		}
+		if upd.TaskState == dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING &&
+			(running == 0 || upd.Timestamp < running) {
+			running = upd.Timestamp
+		}
+	}
+	if running == 0 {
+		return 0, false
+	}
+	return time.Duration(running-first) * time.Millisecond, true
+}
+
+func (td *taskDesc) launchLatencyString() string {
+	latency, ok := td.launchLatency()
+	if !ok {
+		return ""
+	}
+	return latency.String()
+}
+
+// deployState reports whether the task belongs to its request's active or
+// pending deploy.
+func (td *taskDesc) deployState() string {
+	return requestDeployState(td.SingularityRequestParent, td.SingularityTaskId.DeployId)
+}
 
+// staleDeploy is true of tasks that aren't of their request's active deploy,
+// when it has one.
+func (td *taskDesc) staleDeploy() bool {
+	req := td.SingularityRequestParent
+	if req == nil || req.ActiveDeploy == nil {
+		return false
+	}
+	return td.SingularityTaskId.DeployId != req.ActiveDeploy.Id
+}
+
+// currentDeploy is whether td belongs to its request's active deploy.
+func (td *taskDesc) currentDeploy() bool {
+	req := td.SingularityRequestParent
+	return req != nil && req.ActiveDeploy != nil && td.SingularityTaskId.DeployId == req.ActiveDeploy.Id
+}
+
+func (td *taskDesc) staleDeployString() string {
+	if td.staleDeploy() {
+		return "stale"
+	}
+	return ""
+}
+
+func requestDeployState(req *dtos.SingularityRequestParent, deployID string) string {
+	if req == nil {
+		return ""
+	}
+	switch {
+	case req.ActiveDeploy != nil && req.ActiveDeploy.Id == deployID:
+		return "active"
+	case req.PendingDeploy != nil && req.PendingDeploy.Id == deployID:
+		return "pending"
+	}
+	return ""
+}
+
+// printEmpty prints a row for each of the placeholders of empty whose
+// request, at its Singularity, had no task printed. With --print-deploy-state
+// the row carries its request's deploy result, which is often why it has no
+// tasks.
+func printEmpty(out output, opts *options, clients map[string]*singularity.Client, empty []*taskDesc, printedReqs map[string]struct{}) {
+	for _, td := range empty {
+		if _, printed := printedReqs[td.requestKey()]; !printed {
+			if opts.printDeployState {
+				td.DeployResult = scanner.DeployResult(scanner.Options{URL: td.URL, Client: clients[td.URL], Debug: debugLog}, td.SingularityTaskId.RequestId)
+			}
+			out.row(td, opts)
+			printedReqs[td.requestKey()] = struct{}{}
+		}
+	}
+}
+
+func tabRow(out output, opts *options, dbTasks chan<- *taskDesc, seenEnv, printedReqs map[string]struct{}, line *taskDesc) {
+	if opts.warnUnknownEnv {
+		noteEnv(line, seenEnv)
+	}
+	if printable(line, opts) {
+		out.row(line.decoded(opts).redacted(opts), opts)
+		printedReqs[line.requestKey()] = struct{}{}
+	}
+	if opts.redactDb {
+		line = line.redacted(opts)
+	}
+	dbTasks <- line
+}
+
+// reportTiming summarizes the work of a scan on stderr.
+func reportTiming(elapsed time.Duration, requests, tasks int, fetchTime time.Duration) {
+	perTask := time.Duration(0)
+	if tasks > 0 {
+		perTask = fetchTime / time.Duration(tasks)
+	}
+	fmt.Fprintf(os.Stderr, "Scanned %d requests and %d tasks in %s, with %d API calls; %s per task on average\n",
+		requests, tasks, elapsed.Round(time.Millisecond), atomic.LoadInt64(&apiCalls), perTask.Round(time.Microsecond))
+}
+
+func noteEnv(desc *taskDesc, seenEnv map[string]struct{}) {
+	env := desc.Env()
+	if env == nil {
+		return
+	}
 	for _, v := range env.Variables {
-		vars[v.Name] = v.Value
+		seenEnv[v.Name] = struct{}{}
 	}
+}
 
+func warnUnknownEnv(opts *options, seenEnv map[string]struct{}) {
 	for _, e := range opts.env {
-		if v, ok := vars[e]; ok {
-			vals = append(vals, v)
-		} else {
-			vals = append(vals, "")
+		if _, ok := seenEnv[e]; !ok {
+			log.Printf("Warning: no task had environment variable %q", e)
 		}
 	}
+}
 
-	if opts.printStatus {
-		status := "UNKNOWN"
-		if td.SingularityTaskHistoryUpdate != nil {
-			status = string(td.SingularityTaskHistoryUpdate.TaskState)
-		}
-		vals = append(vals, status)
+func printable(desc *taskDesc, opts *options) bool {
+	debug("printable: %s %v %s", opts.scope,
+		desc.SingularityTaskHistoryUpdate,
+		desc.status())
+	if !deploySelected(desc, opts) || !whereMatches(desc, opts) {
+		return false
+	}
+	if opts.oomOnly && !desc.oom() {
+		return false
+	}
+	if opts.onlyDocker && desc.DockerInfo == nil || opts.withoutDocker && desc.DockerInfo != nil {
+		return false
 	}
-	if opts.printDockerImage {
-		if td.DockerInfo == nil {
-			vals = append(vals, "<? none ?>")
-		} else {
-			vals = append(vals, td.DockerInfo.Image)
+	if opts.onlyMissingEnv && len(desc.missingEnv(opts)) == 0 {
+		return false
+	}
+	if opts.sinceDeploy && !desc.currentDeploy() {
+		return false
+	}
+	running := desc.running()
+	switch opts.scope {
+	case scopeInactive:
+		return !running
+	case scopeAll:
+		return true
+	}
+	return running
+}
+
+// hasPrefix is true if id starts with any of prefixes.
+func hasPrefix(id string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(id, prefix) {
+			return true
 		}
 	}
+	return false
+}
 
-	return vals
+func requestSelected(req *dtos.SingularityRequestParent, opts *options) bool {
+	if len(opts.prefix) > 0 && !hasPrefix(req.Request.Id, opts.prefix) {
+		debug("Skipping %s: no --prefix matches", req.Request.Id)
+		return false
+	}
+	if opts.user != "" && activeDeployUser(req) != opts.user {
+		debug("Skipping %s: not deployed by %s", req.Request.Id, opts.user)
+		return false
+	}
+	if opts.ignorePaused && pausedOrCoolingDown(req) {
+		debug("Skipping %s: %s", req.Request.Id, req.State)
+		return false
+	}
+	instances := int(req.Request.Instances)
+	if opts.minInstancesSet && instances < opts.minInstances ||
+		opts.maxInstancesSet && instances > opts.maxInstances {
+		debug("Skipping %s: %d instances", req.Request.Id, instances)
+		return false
+	}
+	return true
+}
+
+func pausedOrCoolingDown(req *dtos.SingularityRequestParent) bool {
+	return req.State == dtos.SingularityRequestParentRequestStatePAUSED ||
+		req.State == dtos.SingularityRequestParentRequestStateSYSTEM_COOLDOWN
+}
+
+func activeDeployUser(req *dtos.SingularityRequestParent) string {
+	if req.RequestDeployState == nil || req.RequestDeployState.ActiveDeploy == nil {
+		return ""
+	}
+	return req.RequestDeployState.ActiveDeploy.User
+}
+
+func deploySelected(desc *taskDesc, opts *options) bool {
+	if len(opts.deploy) == 0 {
+		return true
+	}
+	for _, d := range opts.deploy {
+		if desc.SingularityTaskId.DeployId == d {
+			return true
+		}
+	}
+	return false
 }
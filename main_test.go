@@ -0,0 +1,1009 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyarly/cygnus/scanner"
+	singularity "github.com/opentable/go-singularity"
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+func taskIDs(tasks []*taskDesc) []string {
+	ids := []string{}
+	for _, td := range tasks {
+		ids = append(ids, td.SingularityTaskId.Id)
+	}
+	return ids
+}
+
+func TestFakeClientRequests(t *testing.T) {
+	client, _ := fakeClient(t, parseArgs([]string{"http://example.com"}))
+	reqs, err := client.GetRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 3 {
+		t.Errorf("got %d requests, want 3", len(reqs))
+	}
+}
+
+// TestPrintScopes checks that only the tasks in the --scope are printed,
+// though a request's history may list tasks in the other.
+func TestPrintScopes(t *testing.T) {
+	cases := []struct {
+		scope string
+		want  []string
+	}{
+		{"active", []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d2-1"}},
+		{"inactive", []string{"team-web-d1-3"}},
+		{"all", []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d1-3", "team-web-d2-1"}},
+	}
+	for _, c := range cases {
+		opts, tasks := scanFake(t, "--scope="+c.scope)
+		printed := []*taskDesc{}
+		for _, td := range tasks {
+			if printable(td, opts) {
+				printed = append(printed, td)
+			}
+		}
+		if got := taskIDs(printed); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("--scope=%s printed %v, want %v", c.scope, got, c.want)
+		}
+	}
+}
+
+func TestActiveFlags(t *testing.T) {
+	for _, c := range []struct {
+		opts  options
+		scope string
+	}{
+		{options{}, scopeActive},
+		{options{active: true}, scopeActive},
+		{options{noActive: true}, scopeInactive},
+		{options{noPrintActive: true}, scopeInactive},
+	} {
+		if scope, err := resolveScope(&c.opts); err != nil || scope != c.scope {
+			t.Errorf("%+v: got scope %q (%v), want %q", c.opts, scope, err, c.scope)
+		}
+	}
+
+	for _, bad := range []options{
+		{active: true, noActive: true},
+		{noActive: true, scope: scopeAll},
+		{active: true, noPrintActive: true},
+	} {
+		if _, err := resolveScope(&bad); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+
+	opts := parseArgs([]string{"--no-active", "http://singularity.example.com"})
+	if opts.scope != scopeInactive || opts.printActive {
+		t.Errorf("--no-active: got scope %q, printActive %v", opts.scope, opts.printActive)
+	}
+}
+
+func TestTableOutput(t *testing.T) {
+	opts, tasks := scanFake(t, "--print-status", "--env=PORT0", "--ignore-paused")
+
+	buf := &bytes.Buffer{}
+	out := newFormatOutput(opts, buf)
+	out.header(opts)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	want := "" +
+		"Request ID Deploy ID State  PORT0 Task Status\n" +
+		"other-svc  o1               31001 TASK_RUNNING\n" +
+		"team-web   d1               31002 TASK_RUNNING\n" +
+		"team-web   d2        active 31001 TASK_RUNNING\n"
+	if got := buf.String(); got != want {
+		t.Errorf("table output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMarkdownOutput(t *testing.T) {
+	opts, tasks := scanFake(t, "--format=markdown", "--env=PORT0")
+	td := tasks[0]
+	if td.SingularityTaskId.RequestId != "other-svc" {
+		t.Fatalf("first task is of %s", td.SingularityTaskId.RequestId)
+	}
+	td.SingularityTaskId.DeployId = "o|1"
+
+	buf := &bytes.Buffer{}
+	out := newFormatOutput(opts, buf)
+	out.row(td, opts)
+	out.flush()
+
+	want := "" +
+		"| Request ID | Deploy ID | State | PORT0 |\n" +
+		"| --- | --- | --- | --- |\n" +
+		"| other-svc | o\\|1 |  | 31001 |\n"
+	if got := buf.String(); got != want {
+		t.Errorf("markdown output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	for _, pretty := range []bool{false, true} {
+		opts, tasks := scanFake(t, "--format=json", "--env=PORT0")
+		opts.jsonPretty = pretty
+
+		buf := &bytes.Buffer{}
+		out := newFormatOutput(opts, buf)
+		for _, td := range tasks {
+			out.row(td, opts)
+		}
+		out.flush()
+
+		var records []TaskRecord
+		if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+			t.Fatalf("pretty %v: %v in %s", pretty, err, buf)
+		}
+		if len(records) != len(tasks) {
+			t.Errorf("pretty %v: %d records of %d tasks", pretty, len(records), len(tasks))
+		}
+		if lines := bytes.Count(buf.Bytes(), []byte("\n")); (lines > 1) != pretty {
+			t.Errorf("pretty %v: output has %d lines", pretty, lines)
+		}
+	}
+}
+
+func TestIDsOutput(t *testing.T) {
+	opts, tasks := scanFake(t, "--format=ids", "--null")
+
+	buf := &bytes.Buffer{}
+	out := newFormatOutput(opts, buf)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	want := strings.Join(taskIDs(tasks), "\x00") + "\x00"
+	if got := buf.String(); got != want {
+		t.Errorf("ids output %q, want %q", got, want)
+	}
+}
+
+func TestAppendOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	write := func(opts *options, line string) {
+		w, closeOut, err := openDestination(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, line)
+		if err := closeOut(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(&options{output: path}, "one\n")
+	write(&options{output: path, appendOutput: true}, "two\n")
+	if got, _ := ioutil.ReadFile(path); string(got) != "one\ntwo\n" {
+		t.Errorf("appended output %q", got)
+	}
+	write(&options{output: path}, "three\n")
+	if got, _ := ioutil.ReadFile(path); string(got) != "three\n" {
+		t.Errorf("truncated output %q", got)
+	}
+}
+
+func TestRequestTotals(t *testing.T) {
+	opts, tasks := scanFake(t, "--request-totals", "--scope=all", "--print-usage")
+
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	out.header(opts)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	// Only one of team-web's tasks has statistics to tell its allocation.
+	want := "Request ID Running CPUs Memory Mem Used\n" +
+		"team-web   2       1    512MiB 200MiB\n" +
+		"other-svc  1       0    0MiB   \n"
+	if got := buf.String(); got != want {
+		t.Errorf("request totals:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRolloutPerSingularity(t *testing.T) {
+	opts, tasks := scanFakes(t, "--rollout", "--request-id=team-web")
+
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	out.header(opts)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "Singularity ") {
+		t.Fatalf("rollout of team-web at two Singularities:\n%s", buf)
+	}
+	urls := append([]string{}, opts.url...)
+	sort.Strings(urls)
+	for i, url := range urls {
+		for _, line := range lines[1+2*i : 3+2*i] {
+			if !strings.HasPrefix(line, url+" ") || !strings.Contains(line, "[##########..........]  50%") {
+				t.Errorf("rollout of team-web at %s:\n%s", url, buf)
+			}
+		}
+	}
+}
+
+func TestRequestTotalsPerSingularity(t *testing.T) {
+	opts, tasks := scanFakes(t, "--request-totals", "--request-id=team-web", "--print-usage")
+
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	out.header(opts)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	urls := append([]string{}, opts.url...)
+	sort.Strings(urls)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "Singularity ") {
+		t.Fatalf("totals of team-web at two Singularities:\n%s", buf)
+	}
+	for i, url := range urls {
+		if fields := strings.Fields(lines[1+i]); !reflect.DeepEqual(fields, []string{url, "team-web", "2", "1", "512MiB", "200MiB"}) {
+			t.Errorf("totals of team-web at %s:\n%s", url, buf)
+		}
+	}
+}
+
+func TestCPUUsage(t *testing.T) {
+	opts, tasks := scanFake(t, "--print-usage", "--request-id=team-web")
+	var td *taskDesc
+	for _, task := range tasks {
+		if task.SingularityTaskId.Id == "team-web-d2-1" {
+			td = task
+		}
+	}
+	if td == nil || td.Usage == nil {
+		t.Fatalf("no statistics for team-web-d2-1 in %v", taskIDs(tasks))
+	}
+
+	// 15 CPU seconds over the minute from TASK_RUNNING at 6s to the
+	// statistics at 66s.
+	if got := td.cpuUsage(); got != "0.25/1" {
+		t.Errorf("CPU usage %q, want 0.25/1", got)
+	}
+	if used := td.toRecord(opts).Usage.CPUUsed; used == nil || *used != 0.25 {
+		t.Errorf("record's CPU used is %v, want 0.25", used)
+	}
+
+	// Without a timestamp on the statistics, uptime runs to now.
+	freezeClock(t, time.Unix(36, 0))
+	untimed := *td
+	usage := *td.Usage
+	usage.Timestamp = 0
+	untimed.Usage = &usage
+	if got := untimed.cpuUsage(); got != "0.50/1" {
+		t.Errorf("CPU usage without a timestamp %q, want 0.50/1", got)
+	}
+}
+
+func TestGroupByRequestPerSingularity(t *testing.T) {
+	opts, tasks := scanFakes(t, "--group-by-request", "--request-id=team-web", "--no-print-headers")
+
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	groups := strings.Split(buf.String(), "\n\n")
+	if len(groups) != 2 {
+		t.Fatalf("team-web at two Singularities grouped as:\n%s", buf)
+	}
+	for i, url := range []string{tasks[0].URL, tasks[len(tasks)-1].URL} {
+		lines := strings.Split(strings.TrimSuffix(groups[i], "\n"), "\n")
+		if len(lines) != 3 || lines[0] != "team-web at "+url {
+			t.Errorf("group %d of team-web at two Singularities:\n%s", i, groups[i])
+		}
+	}
+}
+
+func TestRequestCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	freezeClock(t, at)
+
+	srv := fakeSingularity(t)
+	client, err := newClient(&options{}, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs, err := getRequests(client, srv.URL, time.Minute); err != nil || len(reqs) != 3 {
+		t.Fatalf("fetched %d requests: %v", len(reqs), err)
+	}
+
+	path, err := requestCachePath(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("cache at %s: %v, %v", path, info, err)
+	}
+
+	// With the Singularity gone, only a fresh cache answers.
+	srv.Close()
+	freezeClock(t, at.Add(59*time.Second))
+	if reqs, err := getRequests(client, srv.URL, time.Minute); err != nil || len(reqs) != 3 {
+		t.Errorf("within a minute, got %d cached requests: %v", len(reqs), err)
+	}
+	freezeClock(t, at.Add(time.Minute))
+	if _, err := getRequests(client, srv.URL, time.Minute); err == nil {
+		t.Error("after a minute, used the stale cache")
+	}
+	if _, err := getRequests(client, srv.URL, 0); err == nil {
+		t.Error("without a ttl, used the cache")
+	}
+}
+
+func TestSampleEnv(t *testing.T) {
+	opts, tasks := scanFake(t, "--sample-env", "--env=PORT0", "--env=TASK_HOST", "--scope=all")
+
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	out.header(opts)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	want := "Request ID Variable  Values\n" +
+		"other-svc  PORT0     31001(1)\n" +
+		"other-svc  TASK_HOST host1(1)\n" +
+		"team-web   PORT0     31001(1), 31002(1), 31003(1)\n" +
+		"team-web   TASK_HOST host1(1), host2(1), host3(1)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("sampled env:\n%s\nwant:\n%s", got, want)
+	}
+
+	opts, tasks = scanFakes(t, "--sample-env", "--env=PORT0", "--request-id=team-web")
+	buf.Reset()
+	out = newOutput(opts, buf)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+	urls := append([]string{}, opts.url...)
+	sort.Strings(urls)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("sampled env at two Singularities:\n%s", buf)
+	}
+	for i, url := range urls {
+		if fields := strings.Fields(lines[i]); !reflect.DeepEqual(fields, []string{url, "team-web", "PORT0", "31001(1),", "31002(1)"}) {
+			t.Errorf("sampled env at %s:\n%s", url, buf)
+		}
+	}
+
+	got := sampledValues(map[string]int{"us-west": 2, "us-east": 5, "eu": 2})
+	if want := "us-east(5), eu(2), us-west(2)"; got != want {
+		t.Errorf("sampled %q, want %q", got, want)
+	}
+}
+
+func TestLimitOutputWarns(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, c := range []struct {
+		arg, warning string
+	}{
+		{"--head=1", "printed 1 of 3 rows"},
+		{"--tail=2", "printed 2 of 3 rows"},
+		{"--head=3", ""},
+	} {
+		logBuf.Reset()
+		opts, tasks := scanFake(t, c.arg)
+		out := newOutput(opts, ioutil.Discard)
+		for _, td := range tasks {
+			out.row(td, opts)
+		}
+		out.flush()
+		if got := logBuf.String(); c.warning == "" && got != "" || !strings.Contains(got, c.warning) {
+			t.Errorf("%s warned %q, want %q", c.arg, got, c.warning)
+		}
+	}
+}
+
+// scanRequest scans the request reqID of a fakeSingularity, returning the
+// tasks and errors the scan reports.
+func scanRequest(t *testing.T, reqID string) ([]scanner.TaskRecord, []error) {
+	srv := fakeSingularity(t)
+	req := &dtos.SingularityRequestParent{Request: &dtos.SingularityRequest{Id: reqID}}
+	tasks, errs := scanner.Scan(context.Background(), scanner.Options{
+		URL:      srv.URL,
+		Requests: dtos.SingularityRequestParentList{req},
+		Debug:    debugLog,
+	})
+
+	var recs []scanner.TaskRecord
+	for rec := range tasks {
+		recs = append(recs, rec)
+	}
+	var errList []error
+	for err := range errs {
+		errList = append(errList, err)
+	}
+	return recs, errList
+}
+
+// scanUntil scans the fakeSingularity at url against deadline, pacing the
+// tasks with limiter, and returns the tasks scanned and those skipped.
+func scanUntil(t *testing.T, url string, scope string, limiter scanner.Limiter, deadline time.Time) (recs []scanner.TaskRecord, skipped []*scanner.Error) {
+	tasks, errs := scanner.Scan(context.Background(), scanner.Options{
+		URL:      url,
+		Scope:    scope,
+		Limiter:  limiter,
+		Deadline: deadline,
+		Debug:    debugLog,
+	})
+	for tasks != nil || errs != nil {
+		select {
+		case rec, ok := <-tasks:
+			if !ok {
+				tasks = nil
+				continue
+			}
+			recs = append(recs, rec)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			var serr *scanner.Error
+			if !errors.As(err, &serr) || serr.Err != scanner.ErrDeadline {
+				t.Errorf("unexpected error: %v", err)
+				continue
+			}
+			skipped = append(skipped, serr)
+		}
+	}
+	return recs, skipped
+}
+
+func TestScanWithoutContainer(t *testing.T) {
+	debugBuf := &bytes.Buffer{}
+	debugLog.SetOutput(debugBuf)
+	defer debugLog.SetOutput(ioutil.Discard)
+
+	recs, errs := scanRequest(t, "native")
+	if len(errs) > 0 || len(recs) != 1 {
+		t.Fatalf("got %d tasks and errors %v, want 1 task", len(recs), errs)
+	}
+
+	td := &taskDesc{recs[0]}
+	if td.DockerInfo != nil {
+		t.Errorf("got docker info %#v for a containerless task", td.DockerInfo)
+	}
+	if got := columnProducers["docker"].value(td); got != "<? none ?>" {
+		t.Errorf("docker column is %q", got)
+	}
+	if debugBuf.Len() == 0 {
+		t.Error("expected debug output")
+	}
+}
+
+func TestScanWithoutCommand(t *testing.T) {
+	recs, errs := scanRequest(t, "partial")
+	if len(errs) > 0 || len(recs) != 1 {
+		t.Fatalf("got %d tasks and errors %v, want 1 task", len(recs), errs)
+	}
+
+	td := &taskDesc{recs[0]}
+	if td.Env() != nil || td.envVar("PORT0") != "" {
+		t.Errorf("got environment %#v for a task without a command", td.Env())
+	}
+	if got := td.status(); got != "TASK_RUNNING" {
+		t.Errorf("status is %q", got)
+	}
+	if got := columnProducers["docker"].value(td); got != "registry.example.com/partial:1" {
+		t.Errorf("docker column is %q", got)
+	}
+	if rec := td.toRecord((&options{}).full()); len(rec.Env) != 0 || rec.AgentID != "" {
+		t.Errorf("record %#v", rec)
+	}
+}
+
+func TestScanWithoutUpdates(t *testing.T) {
+	recs, errs := scanRequest(t, "empty")
+	if len(errs) > 0 || len(recs) != 1 {
+		t.Fatalf("got %d tasks and errors %v, want 1 task", len(recs), errs)
+	}
+
+	td := &taskDesc{recs[0]}
+	if td.SingularityTaskHistoryUpdate != nil {
+		t.Errorf("got last update %#v for a task without updates", td.SingularityTaskHistoryUpdate)
+	}
+	if got := td.status(); got != "UNKNOWN" {
+		t.Errorf("status is %q", got)
+	}
+}
+
+func TestScanNamedRequests(t *testing.T) {
+	_, tasks := scanFake(t, "--request-id=team-web", "--request-id=no-such-request")
+	if got, want := taskIDs(tasks), []string{"team-web-d1-2", "team-web-d2-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+	for _, td := range tasks {
+		if td.deployState() == "" && td.SingularityTaskId.DeployId == "d2" {
+			t.Errorf("task %s lacks its request's deploy state", td.SingularityTaskId.Id)
+		}
+	}
+}
+
+func TestDeployResult(t *testing.T) {
+	_, tasks := scanFake(t, "--print-deploy-state")
+	if len(tasks) == 0 {
+		t.Fatal("no tasks scanned")
+	}
+	for _, td := range tasks {
+		got := td.deployResult()
+		switch td.SingularityTaskId.RequestId {
+		case "other-svc":
+			if want := "FAILED: Task failed health checks"; got != want {
+				t.Errorf("deploy result of %s is %q, want %q", td.SingularityTaskId.Id, got, want)
+			}
+		default:
+			if got != "" {
+				t.Errorf("deploy result of %s is %q, want none", td.SingularityTaskId.Id, got)
+			}
+		}
+	}
+}
+
+func TestScanParallelRequests(t *testing.T) {
+	_, serial := scanFake(t, "--scope=all")
+	_, parallel := scanFake(t, "--scope=all", "--parallel-requests=4")
+	if got, want := taskIDs(parallel), taskIDs(serial); !reflect.DeepEqual(got, want) {
+		t.Errorf("parallel scan found %v, want %v", got, want)
+	}
+}
+
+func TestStaleDeploy(t *testing.T) {
+	_, tasks := scanFake(t, "--request-id=team-web")
+	for _, td := range tasks {
+		want := td.SingularityTaskId.DeployId != "d2"
+		if got := td.staleDeploy(); got != want {
+			t.Errorf("task %s stale: %v, want %v", td.SingularityTaskId.Id, got, want)
+		}
+	}
+}
+
+func TestSinceDeploy(t *testing.T) {
+	opts, tasks := scanFake(t, "--request-id=team-web", "--since-deploy", "--scope=all")
+	printed := []*taskDesc{}
+	for _, td := range tasks {
+		if printable(td, opts) {
+			printed = append(printed, td)
+		}
+	}
+	if got, want := taskIDs(printed), []string{"team-web-d2-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("printed %v, want %v", got, want)
+	}
+}
+
+func TestFlapping(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	freezeClock(t, now)
+	ended := func(id, deploy string, ago time.Duration) *dtos.SingularityTaskIdHistory {
+		return &dtos.SingularityTaskIdHistory{
+			TaskId:    &dtos.SingularityTaskId{Id: id, RequestId: "web", DeployId: deploy},
+			UpdatedAt: now.Add(-ago).UnixNano() / int64(time.Millisecond),
+		}
+	}
+	// Instance 1 of deploy d3 has crashed four times in the last hour; the
+	// tasks of d2 were killed by the deploy, and d3 lost one task long ago.
+	history := dtos.SingularityTaskIdHistoryList{
+		ended("web-d3-1-e", "d3", 5*time.Minute),
+		ended("web-d3-1-d", "d3", 15*time.Minute),
+		ended("web-d3-1-c", "d3", 25*time.Minute),
+		ended("web-d3-1-b", "d3", 35*time.Minute),
+		ended("web-d2-1", "d2", 40*time.Minute),
+		ended("web-d2-2", "d2", 40*time.Minute),
+		ended("web-d3-2-a", "d3", 3*time.Hour),
+	}
+	td := &taskDesc{scanner.TaskRecord{
+		SingularityTaskId: &dtos.SingularityTaskId{Id: "web-d3-1-f", RequestId: "web", DeployId: "d3"},
+		RequestHistory:    history,
+	}}
+
+	if got := td.replacements(time.Hour); got != 4 {
+		t.Errorf("counted %d replaced tasks in the last hour, want 4", got)
+	}
+	if got := td.replacements(4 * time.Hour); got != 5 {
+		t.Errorf("counted %d replaced tasks in the last 4 hours, want 5", got)
+	}
+	if td.flapping(&options{flapThreshold: 4, flapWindow: time.Hour}) {
+		t.Error("flapping at the threshold")
+	}
+	if !td.flapping(&options{flapThreshold: 3, flapWindow: time.Hour}) {
+		t.Error("not flapping beyond the threshold")
+	}
+}
+
+func TestFlappingScan(t *testing.T) {
+	freezeClock(t, time.Unix(60, 0))
+	opts, tasks := scanFake(t, "--columns=task,flapping", "--where=flapping~flapping", "--flap-threshold=0", "--flap-window=5m")
+	if !opts.flapHistory {
+		t.Fatal("the flapping column didn't fetch the requests' histories")
+	}
+	printed := []*taskDesc{}
+	for _, td := range tasks {
+		if printable(td, opts) {
+			printed = append(printed, td)
+		}
+	}
+	// team-web-d1-3, of deploy d1, ended within the window.
+	if got, want := taskIDs(printed), []string{"team-web-d1-2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("flapping: %v, want %v", got, want)
+	}
+	if got := taskValues(opts, printed[0])[1]; got != "flapping (1 replaced)" {
+		t.Errorf("flapping column is %q", got)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	client, _ := fakeClient(t, &options{})
+	reqs, err := client.GetRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range reqs {
+		want := ""
+		if req.Request.Id == "team-batch" {
+			want = "0 * * * *"
+		}
+		if got := emptyRequest("", req).schedule(); got != want {
+			t.Errorf("schedule of %s is %q, want %q", req.Request.Id, got, want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, value := range []string{"", "plain", "it's", `"$HOME" \n`, "a'b'c"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(value)).Output()
+		if err != nil {
+			t.Skipf("no sh: %v", err)
+		}
+		if string(out) != value {
+			t.Errorf("%q came back from the shell as %q", value, out)
+		}
+	}
+}
+
+func TestContainerType(t *testing.T) {
+	_, tasks := scanFake(t, "--print-container-type")
+	want := map[string]string{"team-web": "DOCKER", "other-svc": "MESOS", "native": "none"}
+	for _, td := range tasks {
+		reqID := td.SingularityTaskId.RequestId
+		if w, ok := want[reqID]; ok && td.containerType() != w {
+			t.Errorf("container type of %s is %q, want %q", td.SingularityTaskId.Id, td.containerType(), w)
+		}
+	}
+}
+
+func TestDockerFilters(t *testing.T) {
+	opts, tasks := scanFake(t, "--only-docker")
+	without := *opts
+	without.onlyDocker, without.withoutDocker = false, true
+
+	docker, other := []string{}, []string{}
+	for _, td := range tasks {
+		if printable(td, opts) {
+			docker = append(docker, td.SingularityTaskId.Id)
+		}
+		if printable(td, &without) {
+			other = append(other, td.SingularityTaskId.Id)
+		}
+	}
+	if want := []string{"team-web-d1-2", "team-web-d2-1"}; !reflect.DeepEqual(docker, want) {
+		t.Errorf("--only-docker printed %v, want %v", docker, want)
+	}
+	if want := []string{"other-svc-o1-1"}; !reflect.DeepEqual(other, want) {
+		t.Errorf("--without-docker printed %v, want %v", other, want)
+	}
+}
+
+func TestRequireEnv(t *testing.T) {
+	opts, tasks := scanFake(t, "--require-env=PORT0", "--require-env=SECRET", "--only-missing-env", "--scope=all")
+	missing := map[string][]string{}
+	for _, td := range tasks {
+		if printable(td, opts) {
+			missing[td.SingularityTaskId.Id] = td.missingEnv(opts)
+		}
+	}
+	want := map[string][]string{
+		"team-web-d1-2":  {"SECRET"},
+		"team-web-d1-3":  {"SECRET"},
+		"team-web-d2-1":  {"SECRET"},
+		"other-svc-o1-1": {"SECRET"},
+	}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing %v, want %v", missing, want)
+	}
+
+	// A task without an environment lacks every variable.
+	recs, _ := scanRequest(t, "partial")
+	if len(recs) != 1 {
+		t.Fatalf("got %d partial tasks", len(recs))
+	}
+	if got := (&taskDesc{recs[0]}).missingEnv(opts); !reflect.DeepEqual(got, []string{"PORT0", "SECRET"}) {
+		t.Errorf("task without an environment is missing %v", got)
+	}
+}
+
+func TestInstanceBounds(t *testing.T) {
+	_, tasks := scanFake(t, "--min-instances=2", "--max-instances=2")
+	if got, want := taskIDs(tasks), []string{"team-web-d1-2", "team-web-d2-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+
+	_, tasks = scanFake(t, "--max-instances=0")
+	if len(tasks) != 0 {
+		t.Errorf("scanned %v with --max-instances=0", taskIDs(tasks))
+	}
+}
+
+func TestRack(t *testing.T) {
+	_, tasks := scanFake(t, "--print-rack")
+	want := map[string]string{"team-web-d1-2": "rack2", "other-svc-o1-1": "rack1"}
+	for _, td := range tasks {
+		if w, ok := want[td.SingularityTaskId.Id]; ok && td.rack() != w {
+			t.Errorf("rack of %s is %q, want %q", td.SingularityTaskId.Id, td.rack(), w)
+		}
+	}
+}
+
+func TestOOM(t *testing.T) {
+	for _, c := range []struct {
+		reason, message string
+		oom             bool
+	}{
+		{"REASON_CONTAINER_LIMITATION_MEMORY", "", true},
+		{"", "Memory limit exceeded: Requested: 512MB Maximum Used: 512MB", true},
+		{"", "Container was OOMKilled", true},
+		{"REASON_COMMAND_EXECUTOR_FAILED", "Exited with status 1", false},
+		{"", "Waiting for room on the agent", false},
+	} {
+		td := &taskDesc{}
+		td.SingularityTaskHistoryUpdate = &dtos.SingularityTaskHistoryUpdate{StatusReason: c.reason, StatusMessage: c.message}
+		if got := td.oom(); got != c.oom {
+			t.Errorf("oom(%q, %q) = %v", c.reason, c.message, got)
+		}
+	}
+}
+
+func TestTableLayout(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "a   b\nccc d\n"},
+		{[]string{"--padding=2", "--pad-char=."}, "a....b\nccc..d\n"},
+		{[]string{"--tab-align=right"}, "   a b\n ccc d\n"},
+	} {
+		opts := parseArgs(append(c.args, "http://singularity.example.com"))
+		buf := &bytes.Buffer{}
+		tw := opts.newTabWriter(buf)
+		tw.Write([]byte("a\tb\nccc\td\n"))
+		tw.Flush()
+		if buf.String() != c.want {
+			t.Errorf("%v: got %q, want %q", c.args, buf.String(), c.want)
+		}
+	}
+
+	for _, bad := range []struct {
+		padding        int
+		padChar, align string
+	}{{-1, "", ""}, {1, "ab", ""}, {1, "", "middle"}} {
+		if _, err := parseLayout(bad.padding, bad.padChar, bad.align); err == nil {
+			t.Errorf("parseLayout(%+v): expected an error", bad)
+		}
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	freezeClock(t, time.Unix(96, 0))
+
+	opts, tasks := scanFake(t, "--print-last-seen", "--scope=all")
+	seen := map[string]string{}
+	for _, td := range tasks {
+		seen[td.SingularityTaskId.Id] = td.lastSeenString()
+	}
+	if seen["team-web-d1-3"] != "1m30s ago" || seen["team-web-d1-2"] != "now" {
+		t.Errorf("last seen: %v", seen)
+	}
+
+	for _, state := range []dtos.SingularityTaskHistoryUpdateExtendedTaskState{
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_STARTING,
+		dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_CLEANING,
+	} {
+		td := *tasks[0]
+		td.SingularityTaskHistoryUpdate = &dtos.SingularityTaskHistoryUpdate{TaskState: state, Timestamp: 6000}
+		if got := td.lastSeenString(); got != "now" {
+			t.Errorf("%s task last seen %q, want now", state, got)
+		}
+	}
+
+	for _, td := range tasks {
+		if td.SingularityTaskId.Id != "team-web-d1-3" {
+			continue
+		}
+		record := td.toRecord(opts)
+		if record.LastSeen == nil || !record.LastSeen.Equal(time.Unix(6, 0)) {
+			t.Errorf("record's last seen is %v, want %v", record.LastSeen, time.Unix(6, 0))
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	_, tasks := scanFake(t, "--prefix=team-w", "--prefix=other-", "--scope=all")
+	if got, want := taskIDs(tasks), []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d1-3", "team-web-d2-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+
+	_, tasks = scanFake(t, "--prefix=other-")
+	if got, want := taskIDs(tasks), []string{"other-svc-o1-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	for image, want := range map[string]string{
+		"web:1":                      "docker.io",
+		"library/web:1":              "docker.io",
+		"registry.example.com/web:2": "registry.example.com",
+		"localhost:5000/team/web":    "localhost:5000",
+		"localhost/web@sha256:abc":   "localhost",
+	} {
+		if got := imageRegistry(image); got != want {
+			t.Errorf("registry of %q is %q, want %q", image, got, want)
+		}
+	}
+
+	_, tasks := scanFake(t, "--print-registry")
+	registries := map[string]string{}
+	for _, td := range tasks {
+		registries[td.SingularityTaskId.Id] = td.registry()
+	}
+	if registries["team-web-d1-2"] != "docker.io" || registries["team-web-d2-1"] != "registry.example.com" {
+		t.Errorf("task registries: %v", registries)
+	}
+}
+
+func TestRequestFilenames(t *testing.T) {
+	seen := map[string]string{}
+	for _, url := range []string{"", "http://sing", "http://sing:8080", "http://sing_8080", "http://proxy/sing", "unix:///run/sing.sock"} {
+		for _, reqID := range []string{"team-web", "a/b", "a_b", "a:b", "..", "_.."} {
+			name := requestFilename(url, reqID)
+			if other, dup := seen[name]; dup {
+				t.Errorf("%q and %s %q are both written to %q", other, url, reqID, name)
+			}
+			seen[name] = url + " " + reqID
+		}
+	}
+	if got := requestFilename("", "team-web"); got != "team-web" {
+		t.Errorf("team-web is written to %q", got)
+	}
+	if got := requestFilename("http://sing", "team-web"); got != filepath.Join("sing", "team-web") {
+		t.Errorf("team-web at http://sing is written to %q", got)
+	}
+}
+
+func TestOutputDirPerSingularity(t *testing.T) {
+	opts, tasks := scanFakes(t, "--output-dir="+t.TempDir(), "--format=ids", "--request-id=team-web", "--no-print-headers")
+
+	out := newOutput(opts, ioutil.Discard)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	for _, url := range opts.url {
+		body, err := ioutil.ReadFile(filepath.Join(opts.outputDir, requestFilename(url, "team-web")+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Fields(string(body)); !reflect.DeepEqual(got, []string{"team-web-d1-2", "team-web-d2-1"}) {
+			t.Errorf("team-web at %s written as %q", url, body)
+		}
+	}
+}
+
+func TestPrintEmptyPerSingularity(t *testing.T) {
+	req := &dtos.SingularityRequestParent{Request: &dtos.SingularityRequest{Id: "team-web"}}
+	printed := map[string]struct{}{}
+	printed[(&taskDesc{scanner.TaskRecord{URL: "http://one", SingularityTaskId: &dtos.SingularityTaskId{RequestId: "team-web"}}}).requestKey()] = struct{}{}
+
+	opts := &options{format: "ndjson"}
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	printEmpty(out, opts, nil, []*taskDesc{emptyRequest("http://one", req), emptyRequest("http://two", req)}, printed)
+	out.flush()
+	if got := strings.Count(buf.String(), `"noTasks":true`); got != 1 {
+		t.Errorf("printed %d empty rows, want 1 for the second Singularity:\n%s", got, buf)
+	}
+}
+
+func TestEmptyRequestDeployResult(t *testing.T) {
+	opts := parseArgs([]string{"--print-deploy-state", "--show-empty", "--format=ndjson", "http://singularity.example.com"})
+	client, url := fakeClient(t, opts)
+	reqs, err := client.GetRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req *dtos.SingularityRequestParent
+	for _, r := range reqs {
+		if r.Request.Id == "team-batch" {
+			req = r
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	printEmpty(out, opts, map[string]*singularity.Client{url: client}, []*taskDesc{emptyRequest(url, req)}, map[string]struct{}{})
+	out.flush()
+
+	var record TaskRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v in %q", err, buf)
+	}
+	if want := "FAILED: Deploy timed out"; !record.NoTasks || record.DeployResult != want {
+		t.Errorf("got %+v, want no tasks and deploy result %q", record, want)
+	}
+}
+
+func TestScanDeadlineAfterOverBudgetRequest(t *testing.T) {
+	srv := fakeSingularity(t)
+	// team-web's share of 450ms is 150ms, time for the first of its three
+	// tasks at 4 a second. The others mustn't hold up other-svc's task,
+	// scanned after it.
+	recs, skipped := scanUntil(t, srv.URL, scanner.ScopeAll, newRateLimiter(4), time.Now().Add(450*time.Millisecond))
+
+	scanned := map[string]bool{}
+	for _, rec := range recs {
+		scanned[rec.SingularityTaskId.RequestId] = true
+	}
+	if !scanned["other-svc"] {
+		t.Errorf("other-svc wasn't scanned after team-web ran over its share (skipped %v)", skipped)
+	}
+	for _, err := range skipped {
+		if err.RequestID != "team-web" {
+			t.Errorf("skipped %v, want only tasks of team-web", err)
+		}
+	}
+	if len(skipped) != 2 {
+		t.Errorf("skipped %d tasks, want two of team-web's", len(skipped))
+	}
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// output renders task rows in one of the supported --format styles.
+type output interface {
+	header(opts *options)
+	row(td *taskDesc, opts *options)
+	flush()
+}
+
+var formats = []string{"table", "ndjson", "json", "markdown", "env", "ids"}
+
+// tableLayout is how tables align their columns, from --padding, --pad-char
+// and --tab-align. The zero tableLayout is the default: cells left aligned,
+// and padded with a space.
+type tableLayout struct {
+	custom   bool
+	padding  int
+	padChar  byte
+	tabWidth int
+	flags    uint
+}
+
+func parseLayout(padding int, padChar, align string) (tableLayout, error) {
+	layout := tableLayout{custom: true, padding: padding, padChar: ' '}
+	if padding < 0 {
+		return layout, fmt.Errorf("invalid --padding %d", padding)
+	}
+	switch padChar {
+	case "":
+	case "tab", `\t`, "\t":
+		// Tabs line up with tab stops, so tabwriter needs their width.
+		layout.padChar, layout.tabWidth = '\t', 8
+	default:
+		if len(padChar) != 1 {
+			return layout, fmt.Errorf("invalid --pad-char %q: expected a single character or \"tab\"", padChar)
+		}
+		layout.padChar = padChar[0]
+	}
+	switch align {
+	case "", "left":
+	case "right":
+		layout.flags |= tabwriter.AlignRight
+	default:
+		return layout, fmt.Errorf("invalid --tab-align %q: expected left or right", align)
+	}
+	return layout, nil
+}
+
+// tableWriter aligns tab separated cells into columns.
+type tableWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// rightAligned ends every line with a tab: tabwriter only aligns cells that
+// a tab terminates, which leaves a right aligned table's last column stuck to
+// the one before it.
+type rightAligned struct {
+	*tabwriter.Writer
+}
+
+func (ra rightAligned) Write(p []byte) (int, error) {
+	if _, err := ra.Writer.Write(bytes.Replace(p, []byte("\n"), []byte("\t\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newTabWriter aligns the columns written to w as opts.layout says.
+func (opts *options) newTabWriter(w io.Writer) tableWriter {
+	l := opts.layout
+	if !l.custom {
+		return tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	}
+	tw := tabwriter.NewWriter(w, 0, l.tabWidth, l.padding, l.padChar, l.flags)
+	if l.flags&tabwriter.AlignRight != 0 {
+		return rightAligned{tw}
+	}
+	return tw
+}
+
+// openDestination opens the --output file, compressing it when --gzip is set
+// or the file name ends in ".gz". Without --output, it writes to stdout.
+// An existing file is truncated, unless --append-output is set.
+// The returned close func must be called to flush everything to disk.
+func openDestination(opts *options) (io.Writer, func() error, error) {
+	if opts.output == "" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.appendOutput {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(opts.output, flags, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !opts.gzip && !strings.HasSuffix(opts.output, ".gz") {
+		return f, f.Close, nil
+	}
+
+	gz := gzip.NewWriter(f)
+	return gz, func() error {
+		if err := gz.Close(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
+
+var formatExtensions = map[string]string{
+	"table":    ".txt",
+	"ndjson":   ".ndjson",
+	"json":     ".json",
+	"env":      ".env",
+	"ids":      ".txt",
+	"markdown": ".md",
+	"template": ".txt",
+}
+
+func newOutput(opts *options, w io.Writer) output {
+	if opts.head > 0 || opts.tail > 0 {
+		limited := *opts
+		limited.head, limited.tail = 0, 0
+		return &limitOutput{out: newOutput(&limited, w), head: opts.head, tail: opts.tail}
+	}
+	if opts.outputDir != "" {
+		return newDirOutput(opts)
+	}
+	if opts.groupByRequest {
+		return &groupedOutput{w: w, opts: opts, tasks: map[string][]*taskDesc{}}
+	}
+	if opts.alignFinal {
+		return &finalOutput{out: newFormatOutput(opts, w), opts: opts}
+	}
+	return newFormatOutput(opts, w)
+}
+
+func newFormatOutput(opts *options, w io.Writer) output {
+	if opts.rollout {
+		return newRolloutOutput(opts, w)
+	}
+	if opts.requestTotals {
+		return newTotalsOutput(opts, w)
+	}
+	if opts.sampleEnv {
+		return newSampleOutput(opts, w)
+	}
+	if opts.compact {
+		return &compactOutput{w}
+	}
+	switch opts.format {
+	default:
+		if opts.envLong {
+			return &envLongOutput{opts.newTabWriter(w), nonEnvColumns(opts)}
+		}
+		if opts.allEnv {
+			return &allEnvOutput{w: w, opts: opts}
+		}
+		return &tableOutput{opts.newTabWriter(w)}
+	case "ndjson":
+		return &ndjsonOutput{json.NewEncoder(w)}
+	case "json":
+		return &jsonOutput{w: w, pretty: opts.jsonPretty, records: []TaskRecord{}}
+	case "template":
+		return &templateOutput{w, opts.tmpl}
+	case "markdown":
+		return &markdownOutput{w: w, opts: opts}
+	case "env":
+		return &envOutput{w}
+	case "ids":
+		sep := "\n"
+		if opts.null {
+			sep = "\x00"
+		}
+		return &idsOutput{w, sep}
+	}
+}
+
+type tableOutput struct {
+	writer tableWriter
+}
+
+func (out *tableOutput) header(opts *options) {
+	out.writer.Write([]byte(strings.Join(headerNames(opts), "\t")))
+	out.writer.Write([]byte{'\n'})
+}
+
+func (out *tableOutput) row(td *taskDesc, opts *options) {
+	out.writer.Write([]byte(tableLine(td, opts)))
+}
+
+// tableLine is td's row of the table, tab separated.
+func tableLine(td *taskDesc, opts *options) string {
+	fields := taskValues(opts, td)
+	if opts.maxColWidth > 0 {
+		for i := range fields {
+			fields[i] = truncate(fields[i], opts.maxColWidth)
+		}
+	}
+	return strings.Join(fields, "\t") + "\n"
+}
+
+func (out *tableOutput) flush() {
+	out.writer.Flush()
+}
+
+// truncate shortens s to at most width runes, marking the cut with an ellipsis.
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width == 1 {
+		return "…"
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// allEnvOutput buffers every task so that the table can have a column for
+// each environment variable set on any of them. Tasks lacking a variable get
+// a blank in its column.
+type allEnvOutput struct {
+	w          io.Writer
+	opts       *options
+	withHeader bool
+	tasks      []*taskDesc
+}
+
+func (out *allEnvOutput) header(opts *options) {
+	out.withHeader = true
+}
+
+func (out *allEnvOutput) row(td *taskDesc, opts *options) {
+	out.tasks = append(out.tasks, td)
+}
+
+func (out *allEnvOutput) flush() {
+	wide := allEnvOptions(out.opts, out.tasks)
+	table := &tableOutput{out.opts.newTabWriter(out.w)}
+	if out.withHeader {
+		table.header(wide)
+	}
+	for _, td := range out.tasks {
+		table.row(td, wide)
+	}
+	table.flush()
+}
+
+// markdownOutput buffers every task, so that with --all-env it knows every
+// column, and then writes them as a GitHub-flavored Markdown table. The
+// table always has its header, which Markdown requires.
+type markdownOutput struct {
+	w     io.Writer
+	opts  *options
+	tasks []*taskDesc
+}
+
+func (out *markdownOutput) header(opts *options) {}
+
+func (out *markdownOutput) row(td *taskDesc, opts *options) {
+	out.tasks = append(out.tasks, td)
+}
+
+func (out *markdownOutput) flush() {
+	opts := out.opts
+	if opts.allEnv {
+		opts = allEnvOptions(opts, out.tasks)
+	}
+
+	headers := headerNames(opts)
+	rules := make([]string, len(headers))
+	for i := range rules {
+		rules[i] = "---"
+	}
+	writeMarkdownRow(out.w, headers)
+	writeMarkdownRow(out.w, rules)
+	for _, td := range out.tasks {
+		fields := taskValues(opts, td)
+		if opts.maxColWidth > 0 {
+			for i := range fields {
+				fields[i] = truncate(fields[i], opts.maxColWidth)
+			}
+		}
+		writeMarkdownRow(out.w, fields)
+	}
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ")
+
+func writeMarkdownRow(w io.Writer, fields []string) {
+	escaped := make([]string, len(fields))
+	for i, f := range fields {
+		escaped[i] = markdownEscaper.Replace(f)
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(escaped, " | "))
+}
+
+// envOutput writes each task's environment as shell export statements, after
+// a comment naming the task, so that they can be sourced or eval'd.
+type envOutput struct {
+	w io.Writer
+}
+
+var shellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (out *envOutput) header(opts *options) {}
+
+func (out *envOutput) row(td *taskDesc, opts *options) {
+	if td.placeholder() {
+		fmt.Fprintf(out.w, "# %s: no tasks\n", td.SingularityTaskId.RequestId)
+		return
+	}
+	fmt.Fprintf(out.w, "# %s\n", td.SingularityTaskId.Id)
+	for _, pair := range longEnv(td, opts) {
+		if !shellName.MatchString(pair[0]) {
+			fmt.Fprintf(out.w, "# skipped %q: not a shell variable name\n", pair[0])
+			continue
+		}
+		fmt.Fprintf(out.w, "export %s=%s\n", pair[0], shellQuote(pair[1]))
+	}
+}
+
+func (out *envOutput) flush() {}
+
+// idsOutput writes just the ID of each task, each followed by sep.
+type idsOutput struct {
+	w   io.Writer
+	sep string
+}
+
+func (out *idsOutput) header(opts *options) {}
+
+func (out *idsOutput) row(td *taskDesc, opts *options) {
+	if td.placeholder() {
+		return
+	}
+	io.WriteString(out.w, td.SingularityTaskId.Id+out.sep)
+}
+
+func (out *idsOutput) flush() {}
+
+// shellQuote quotes s for a POSIX shell: single quoted, with any single
+// quotes in it closed, escaped and reopened.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// allEnvOptions is opts with a column for each environment variable set on
+// any of tasks.
+func allEnvOptions(opts *options, tasks []*taskDesc) *options {
+	seen := map[string]struct{}{}
+	for _, td := range tasks {
+		noteEnv(td, seen)
+	}
+	names := []string{}
+	for name := range seen {
+		if !opts.envExcluded(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	wide := *opts
+	wide.env = names
+	if wide.columns == "" {
+		wide.outputColumns = defaultColumns(&wide)
+	} else {
+		wide.outputColumns = append([]column{}, opts.outputColumns...)
+		for _, name := range names {
+			wide.outputColumns = append(wide.outputColumns, envColumn(name))
+		}
+	}
+	return &wide
+}
+
+// limitOutput passes only the first --head rows on to out, and of those only
+// the last --tail, which it holds until the scan is complete.
+type limitOutput struct {
+	out        output
+	head, tail int
+	rows, all  int
+	tasks      []*taskDesc
+	opts       *options
+}
+
+func (out *limitOutput) header(opts *options) {
+	out.out.header(opts)
+}
+
+func (out *limitOutput) row(td *taskDesc, opts *options) {
+	out.all++
+	if out.head > 0 && out.rows >= out.head {
+		return
+	}
+	out.rows++
+
+	if out.tail == 0 {
+		out.out.row(td, opts)
+		return
+	}
+	out.opts = opts
+	out.tasks = append(out.tasks, td)
+	if len(out.tasks) > out.tail {
+		out.tasks = out.tasks[1:]
+	}
+}
+
+// flush prints the --tail rows, and warns if any were left out.
+func (out *limitOutput) flush() {
+	for _, td := range out.tasks {
+		out.out.row(td, out.opts)
+	}
+	out.out.flush()
+
+	printed := out.rows
+	if out.tail > 0 && len(out.tasks) < printed {
+		printed = len(out.tasks)
+	}
+	if printed < out.all {
+		log.Printf("Warning: output truncated: printed %d of %d rows", printed, out.all)
+	}
+}
+
+// finalOutput holds the header and every row until the scan is complete, and
+// only then writes them to out, so that it aligns them all in one pass.
+type finalOutput struct {
+	out        output
+	opts       *options
+	withHeader bool
+	tasks      []*taskDesc
+}
+
+func (out *finalOutput) header(opts *options) {
+	out.withHeader = true
+}
+
+func (out *finalOutput) row(td *taskDesc, opts *options) {
+	out.tasks = append(out.tasks, td)
+}
+
+func (out *finalOutput) flush() {
+	if out.withHeader {
+		out.out.header(out.opts)
+	}
+	for _, td := range out.tasks {
+		out.out.row(td, out.opts)
+	}
+	out.out.flush()
+}
+
+// groupedOutput buffers tasks by request, and writes them as a table with
+// each request's tasks indented under a line naming it, and the Singularity
+// it's at when there are several.
+type groupedOutput struct {
+	w          io.Writer
+	opts       *options
+	withHeader bool
+	requests   []string // requestKeys, in the order first seen
+	tasks      map[string][]*taskDesc
+}
+
+func (out *groupedOutput) header(opts *options) {
+	out.withHeader = true
+}
+
+func (out *groupedOutput) row(td *taskDesc, opts *options) {
+	key := td.requestKey()
+	if _, have := out.tasks[key]; !have {
+		out.requests = append(out.requests, key)
+	}
+	out.tasks[key] = append(out.tasks[key], td)
+}
+
+func (out *groupedOutput) flush() {
+	opts := out.opts
+	if opts.allEnv {
+		all := []*taskDesc{}
+		for _, key := range out.requests {
+			all = append(all, out.tasks[key]...)
+		}
+		opts = allEnvOptions(opts, all)
+	}
+
+	// The rows are aligned together, and then split into groups, since the
+	// subheaders would interrupt the tabwriter's columns.
+	buf := &bytes.Buffer{}
+	table := opts.newTabWriter(buf)
+	if out.withHeader {
+		table.Write([]byte(strings.Join(headerNames(opts), "\t") + "\n"))
+	}
+	lineCounts := []int{}
+	for _, key := range out.requests {
+		count := 0
+		for _, td := range out.tasks[key] {
+			line := tableLine(td, opts)
+			count += strings.Count(line, "\n")
+			table.Write([]byte(line))
+		}
+		lineCounts = append(lineCounts, count)
+	}
+	table.Flush()
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	if out.withHeader {
+		fmt.Fprintf(out.w, "  %s", lines[0])
+		lines = lines[1:]
+	}
+	for i, key := range out.requests {
+		if i > 0 || out.withHeader {
+			fmt.Fprintln(out.w)
+		}
+		td := out.tasks[key][0]
+		if out.opts.multiSingularity() {
+			fmt.Fprintf(out.w, "%s at %s\n", td.SingularityTaskId.RequestId, td.URL)
+		} else {
+			fmt.Fprintln(out.w, td.SingularityTaskId.RequestId)
+		}
+		for _, line := range lines[:lineCounts[i]] {
+			fmt.Fprintf(out.w, "  %s", line)
+		}
+		lines = lines[lineCounts[i]:]
+	}
+}
+
+// envLongOutput writes a table row for each environment variable of each
+// task, repeating the other columns on every row.
+type envLongOutput struct {
+	writer  tableWriter
+	columns []column
+}
+
+func (out *envLongOutput) header(opts *options) {
+	headers := []string{}
+	for _, col := range out.columns {
+		headers = append(headers, col.header)
+	}
+	headers = append(headers, "Name", "Value")
+	out.writer.Write([]byte(strings.Join(headers, "\t") + "\n"))
+}
+
+func (out *envLongOutput) row(td *taskDesc, opts *options) {
+	var fields []string
+	var pairs [][2]string
+	if td.placeholder() {
+		fields = placeholderValues(out.columns, td)
+		pairs = [][2]string{{"", ""}}
+	} else {
+		for _, col := range out.columns {
+			fields = append(fields, columnValue(col, td, opts))
+		}
+		pairs = longEnv(td, opts)
+	}
+
+	for _, pair := range pairs {
+		row := append(append([]string{}, fields...), pair[0], pair[1])
+		if opts.maxColWidth > 0 {
+			for i := range row {
+				row[i] = truncate(row[i], opts.maxColWidth)
+			}
+		}
+		out.writer.Write([]byte(strings.Join(row, "\t") + "\n"))
+	}
+}
+
+func (out *envLongOutput) flush() {
+	out.writer.Flush()
+}
+
+// longEnv lists the name/value pairs to print for td: the --env variables,
+// or every variable not matched by --env-exclude if none were named or
+// --all-env is set.
+func longEnv(td *taskDesc, opts *options) [][2]string {
+	pairs := [][2]string{}
+	if len(opts.env) > 0 && !opts.allEnv {
+		for _, e := range opts.env {
+			pairs = append(pairs, [2]string{e, td.envVar(e)})
+		}
+		return pairs
+	}
+
+	env := td.Env()
+	if env == nil {
+		return pairs
+	}
+	for _, v := range env.Variables {
+		if !opts.envExcluded(v.Name) {
+			pairs = append(pairs, [2]string{v.Name, v.Value})
+		}
+	}
+	return pairs
+}
+
+// dirOutput groups tasks by request, and writes each request's tasks to its
+// own file in --output-dir once the scan is complete. Scanning several
+// Singularities, each has a subdirectory of its own.
+type dirOutput struct {
+	opts     *options
+	requests []string // requestKeys, in the order first seen
+	tasks    map[string][]*taskDesc
+}
+
+func newDirOutput(opts *options) *dirOutput {
+	return &dirOutput{opts: opts, tasks: map[string][]*taskDesc{}}
+}
+
+func (out *dirOutput) header(opts *options) {}
+
+func (out *dirOutput) row(td *taskDesc, opts *options) {
+	key := td.requestKey()
+	if _, have := out.tasks[key]; !have {
+		out.requests = append(out.requests, key)
+	}
+	out.tasks[key] = append(out.tasks[key], td)
+}
+
+func (out *dirOutput) flush() {
+	if err := os.MkdirAll(out.opts.outputDir, 0755); err != nil {
+		log.Print(err)
+		return
+	}
+	for _, key := range out.requests {
+		if err := out.writeRequest(key); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (out *dirOutput) writeRequest(key string) error {
+	tasks := out.tasks[key]
+	url := ""
+	if out.opts.multiSingularity() {
+		url = tasks[0].URL
+	}
+	path := filepath.Join(out.opts.outputDir, requestFilename(url, tasks[0].SingularityTaskId.RequestId)+formatExtensions[out.opts.format])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	fo := newFormatOutput(out.opts, f)
+	if out.opts.printHeaders {
+		fo.header(out.opts)
+	}
+	for _, td := range tasks {
+		fo.row(td, out.opts)
+	}
+	fo.flush()
+	return f.Close()
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// requestFilename is the path of the file in --output-dir for reqID, of the
+// Singularity at url: under a directory named for the Singularity, unless
+// url is empty.
+func requestFilename(url, reqID string) string {
+	if url == "" {
+		return distinctFilename(reqID)
+	}
+	name := url
+	if strings.HasPrefix(url, unixScheme) {
+		name = strings.TrimPrefix(url, unixScheme)
+	} else if u, err := neturl.Parse(url); err == nil {
+		name = u.Host + u.Path
+	}
+	return filepath.Join(distinctFilename(name), distinctFilename(reqID))
+}
+
+// distinctFilename is safeFilename of name, with a suffix derived from name
+// if safeFilename had to change it, so that names like "a/b" and "a_b" don't
+// share a file.
+func distinctFilename(name string) string {
+	safe := safeFilename(name)
+	if safe != name {
+		safe = fmt.Sprintf("%s-%x", safe, sha256.Sum256([]byte(name)))[:len(safe)+9]
+	}
+	return safe
+}
+
+// safeFilename replaces anything but letters, digits, '.', '_' and '-' so a
+// request ID can be used as a file name.
+func safeFilename(name string) string {
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// compactOutput writes each task as "request/deploy [STATUS] image".
+type compactOutput struct {
+	w io.Writer
+}
+
+func (out *compactOutput) header(opts *options) {}
+
+func (out *compactOutput) row(td *taskDesc, opts *options) {
+	id := td.SingularityTaskId
+	if td.placeholder() {
+		fmt.Fprintf(out.w, "%s [no tasks]\n", id.RequestId)
+		return
+	}
+	status := td.status()
+	if opts.shortStates {
+		status = shortState(status)
+	}
+	line := fmt.Sprintf("%s/%s [%s]", id.RequestId, id.DeployId, status)
+	if td.DockerInfo != nil && td.DockerInfo.Image != "" {
+		line += " " + td.DockerInfo.Image
+	}
+	fmt.Fprintln(out.w, line)
+}
+
+func (out *compactOutput) flush() {}
+
+// ndjsonOutput writes one JSON object per task as soon as it arrives.
+type ndjsonOutput struct {
+	enc *json.Encoder
+}
+
+func (out *ndjsonOutput) header(opts *options) {}
+
+func (out *ndjsonOutput) row(td *taskDesc, opts *options) {
+	if err := out.enc.Encode(td.toRecord(opts)); err != nil {
+		log.Print(err)
+	}
+}
+
+func (out *ndjsonOutput) flush() {}
+
+// jsonOutput collects every task, and writes them as one JSON array once the
+// scan is complete: indented with --json-pretty, compact otherwise.
+type jsonOutput struct {
+	w       io.Writer
+	pretty  bool
+	records []TaskRecord
+}
+
+func (out *jsonOutput) header(opts *options) {}
+
+func (out *jsonOutput) row(td *taskDesc, opts *options) {
+	out.records = append(out.records, td.toRecord(opts))
+}
+
+func (out *jsonOutput) flush() {
+	var text []byte
+	var err error
+	if out.pretty {
+		text, err = json.MarshalIndent(out.records, "", "  ")
+	} else {
+		text, err = json.Marshal(out.records)
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	out.w.Write(append(text, '\n'))
+}
@@ -0,0 +1,177 @@
+package main
+
+import "time"
+
+type (
+	// TaskRecord is the shape of a task in the JSON output formats.
+	// Optional fields are omitted unless the matching --print-* flag is set.
+	TaskRecord struct {
+		RequestID         string                 `json:"requestId"`
+		DeployID          string                 `json:"deployId"`
+		TaskID            string                 `json:"taskId"`
+		Env               map[string]string      `json:"env"`
+		Status            string                 `json:"status,omitempty"`
+		ContainerType     string                 `json:"containerType,omitempty"`
+		DockerImage       string                 `json:"dockerImage,omitempty"`
+		Registry          string                 `json:"registry,omitempty"`
+		AgentID           string                 `json:"agentId,omitempty"`
+		Rack              string                 `json:"rack,omitempty"`
+		Message           string                 `json:"message,omitempty"`
+		Health            string                 `json:"health,omitempty"`
+		Usage             *TaskUsage             `json:"usage,omitempty"`
+		LaunchLatencySecs *float64               `json:"launchLatencySecs,omitempty"`
+		DeployResult      string                 `json:"deployResult,omitempty"`
+		StaleDeploy       bool                   `json:"staleDeploy,omitempty"`
+		Updates           []TaskUpdate           `json:"updates,omitempty"`
+		Replacements      *int                   `json:"replacements,omitempty"`
+		Flapping          bool                   `json:"flapping,omitempty"`
+		Schedule          string                 `json:"schedule,omitempty"`
+		LastSeen          *time.Time             `json:"lastSeen,omitempty"`
+		MissingEnv        []string               `json:"missingEnv,omitempty"`
+		Fields            map[string]interface{} `json:"fields,omitempty"`
+		NoTasks           bool                   `json:"noTasks,omitempty"`
+	}
+
+	// TaskUsage is the resource usage of a running task against its
+	// allocation.
+	TaskUsage struct {
+		CPUSeconds    float64 `json:"cpuSeconds"`
+		CPUs          float64 `json:"cpus"`
+		MemRSSBytes   int64   `json:"memRssBytes"`
+		MemoryMbAlloc float64 `json:"memoryMbAlloc"`
+		// CPUUsed is how many CPUs the task has kept busy on average
+		// since it started running, if that's known.
+		CPUUsed *float64 `json:"cpuUsed,omitempty"`
+	}
+
+	// TaskUpdate is one change in the state of a task.
+	TaskUpdate struct {
+		Time    time.Time `json:"time"`
+		State   string    `json:"state"`
+		Message string    `json:"message,omitempty"`
+	}
+)
+
+// full is opts with every field of a TaskRecord switched on.
+func (opts *options) full() *options {
+	full := *opts
+	full.allEnv = true
+	full.printStatus, full.printDockerImage, full.printAgent = true, true, true
+	full.printMessage, full.printHealth, full.printUsage = true, true, true
+	full.printLaunchLatency, full.printDeployState, full.printStaleDeploy = true, true, true
+	full.printUpdates, full.flapping, full.printSchedule = true, true, true
+	full.printContainerType, full.printRack, full.printLastSeen = true, true, true
+	full.printRegistry = true
+	return &full
+}
+
+func (td *taskDesc) toRecord(opts *options) TaskRecord {
+	if td.placeholder() {
+		record := TaskRecord{
+			RequestID: td.SingularityTaskId.RequestId,
+			Env:       map[string]string{},
+			NoTasks:   true,
+		}
+		if opts.printDeployState {
+			record.DeployResult = td.deployResult()
+		}
+		return record
+	}
+
+	record := TaskRecord{
+		RequestID: td.SingularityTaskId.RequestId,
+		DeployID:  td.SingularityTaskId.DeployId,
+		TaskID:    td.SingularityTaskId.Id,
+		Env:       map[string]string{},
+	}
+
+	if opts.allEnv {
+		if env := td.Env(); env != nil {
+			for _, v := range env.Variables {
+				if !opts.envExcluded(v.Name) {
+					record.Env[v.Name] = v.Value
+				}
+			}
+		}
+	} else {
+		for _, e := range opts.env {
+			record.Env[e] = td.envVar(e)
+		}
+	}
+
+	if opts.printStatus {
+		record.Status = td.status()
+	}
+	if opts.printContainerType {
+		record.ContainerType = td.containerType()
+	}
+	if opts.printDockerImage && td.DockerInfo != nil {
+		record.DockerImage = td.DockerInfo.Image
+	}
+	if opts.printRegistry {
+		record.Registry = td.registry()
+	}
+	if opts.printAgent {
+		record.AgentID = td.agentID()
+	}
+	if opts.printRack {
+		record.Rack = td.rack()
+	}
+	if opts.printMessage {
+		record.Message = td.message()
+	}
+	if opts.printHealth {
+		record.Health = td.health()
+	}
+	if opts.printLaunchLatency {
+		if latency, ok := td.launchLatency(); ok {
+			secs := latency.Seconds()
+			record.LaunchLatencySecs = &secs
+		}
+	}
+	if opts.printDeployState {
+		record.DeployResult = td.deployResult()
+	}
+	if opts.printStaleDeploy {
+		record.StaleDeploy = td.staleDeploy()
+	}
+	if opts.printUpdates {
+		record.Updates = td.updates()
+	}
+	if opts.flapping {
+		replaced := td.replacements(opts.flapWindow)
+		record.Replacements = &replaced
+		record.Flapping = td.flapping(opts)
+	}
+	if opts.printSchedule {
+		record.Schedule = td.schedule()
+	}
+	if opts.printLastSeen {
+		if at, ok := td.lastSeen(); ok {
+			record.LastSeen = &at
+		}
+	}
+	if len(opts.requireEnv) > 0 {
+		record.MissingEnv = td.missingEnv(opts)
+	}
+	if len(opts.fields) > 0 {
+		record.Fields = map[string]interface{}{}
+		for _, fp := range opts.fields {
+			record.Fields[fp.name] = fp.value(td)
+		}
+	}
+	if opts.printUsage && td.Usage != nil {
+		cpus, memMb := td.allocation()
+		record.Usage = &TaskUsage{
+			CPUSeconds:    td.Usage.CpusUserTimeSecs + td.Usage.CpusSystemTimeSecs,
+			CPUs:          cpus,
+			MemRSSBytes:   td.Usage.MemRssBytes,
+			MemoryMbAlloc: memMb,
+		}
+		if used, ok := td.cpuUsed(); ok {
+			record.Usage.CPUUsed = &used
+		}
+	}
+
+	return record
+}
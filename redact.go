@@ -0,0 +1,61 @@
+package main
+
+import dtos "github.com/opentable/go-singularity/dtos"
+
+const redactedValue = "****"
+
+// redacted is td with the values of the --redact variables replaced by
+// "****".
+func (td *taskDesc) redacted(opts *options) *taskDesc {
+	if len(opts.redact) == 0 {
+		return td
+	}
+	return td.withEnvValues(func(name, value string) string {
+		if opts.redactedVar(name) {
+			return redactedValue
+		}
+		return value
+	})
+}
+
+// withEnvValues is td with the value of each environment variable replaced
+// by what change makes of it. The task's details are copied as far as its
+// environment, so td itself is unchanged.
+func (td *taskDesc) withEnvValues(change func(name, value string) string) *taskDesc {
+	env := td.Env()
+	if env == nil {
+		return td
+	}
+
+	vars := dtos.VariableList{}
+	for _, v := range env.Variables {
+		if value := change(v.Name, v.Value); value != v.Value {
+			copied := *v
+			copied.Value = value
+			v = &copied
+		}
+		vars = append(vars, v)
+	}
+
+	newEnv := *env
+	newEnv.Variables = vars
+	cmd := *td.SingularityTask.MesosTask.Command
+	cmd.Environment = &newEnv
+	mesos := *td.SingularityTask.MesosTask
+	mesos.Command = &cmd
+	task := *td.SingularityTask
+	task.MesosTask = &mesos
+
+	copied := *td
+	copied.SingularityTask = &task
+	return &copied
+}
+
+func (opts *options) redactedVar(name string) bool {
+	for _, r := range opts.redact {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
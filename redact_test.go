@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestRedacted(t *testing.T) {
+	opts, tasks := scanFake(t, "--redact=PORT0")
+	td := tasks[0]
+
+	red := td.redacted(opts)
+	if got := red.envVar("PORT0"); got != "****" {
+		t.Errorf("redacted PORT0 is %q", got)
+	}
+	if got := red.envVar("TASK_HOST"); got != td.envVar("TASK_HOST") {
+		t.Errorf("TASK_HOST changed to %q", got)
+	}
+	if got := td.envVar("PORT0"); got == "****" {
+		t.Error("redacting changed the original task")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+const rolloutBarWidth = 20
+
+// rolloutOutput counts each request's tasks by deploy, so that a deploy in
+// progress shows how many tasks the old and new deploys each have.
+type rolloutOutput struct {
+	writer     tableWriter
+	withHeader bool
+	withURL    bool
+	requests   map[string]*rollout
+}
+
+type rollout struct {
+	url, reqID string
+	parent     *dtos.SingularityRequestParent
+	counts     map[string]int
+	total      int
+}
+
+func newRolloutOutput(opts *options, w io.Writer) *rolloutOutput {
+	return &rolloutOutput{
+		writer:   opts.newTabWriter(w),
+		withURL:  opts.multiSingularity(),
+		requests: map[string]*rollout{},
+	}
+}
+
+func (out *rolloutOutput) header(opts *options) {
+	out.withHeader = true
+}
+
+func (out *rolloutOutput) row(td *taskDesc, opts *options) {
+	key := td.requestKey()
+	ro, have := out.requests[key]
+	if !have {
+		ro = &rollout{url: td.URL, reqID: td.SingularityTaskId.RequestId, parent: td.SingularityRequestParent, counts: map[string]int{}}
+		out.requests[key] = ro
+	}
+	if td.placeholder() {
+		return
+	}
+	ro.counts[td.SingularityTaskId.DeployId]++
+	ro.total++
+}
+
+func (out *rolloutOutput) flush() {
+	prefix := func(ro *rollout) string {
+		if out.withURL {
+			return ro.url + "\t"
+		}
+		return ""
+	}
+	if out.withHeader {
+		if out.withURL {
+			fmt.Fprint(out.writer, "Singularity\t")
+		}
+		fmt.Fprintln(out.writer, "Request ID\tDeploy ID\tState\tTasks\tShare")
+	}
+
+	rollouts := []*rollout{}
+	for _, ro := range out.requests {
+		rollouts = append(rollouts, ro)
+	}
+	sort.Slice(rollouts, func(i, j int) bool {
+		if rollouts[i].reqID != rollouts[j].reqID {
+			return rollouts[i].reqID < rollouts[j].reqID
+		}
+		return rollouts[i].url < rollouts[j].url
+	})
+
+	for _, ro := range rollouts {
+		if ro.total == 0 {
+			fmt.Fprintf(out.writer, "%s%s\tno tasks\t\t0\t\n", prefix(ro), ro.reqID)
+			continue
+		}
+
+		deployIDs := []string{}
+		for deployID := range ro.counts {
+			deployIDs = append(deployIDs, deployID)
+		}
+		sort.Strings(deployIDs)
+
+		target := rolloutTarget(ro.parent)
+		for _, deployID := range deployIDs {
+			state := requestDeployState(ro.parent, deployID)
+			if deployID == target {
+				state += "*"
+			}
+			count := ro.counts[deployID]
+			fmt.Fprintf(out.writer, "%s%s\t%s\t%s\t%d\t%s\n", prefix(ro), ro.reqID, deployID, state, count, shareBar(count, ro.total))
+		}
+	}
+	out.writer.Flush()
+}
+
+// rolloutTarget is the deploy a request is moving to: its pending deploy
+// during a rollout, and its active deploy otherwise.
+func rolloutTarget(req *dtos.SingularityRequestParent) string {
+	switch {
+	case req == nil:
+		return ""
+	case req.PendingDeploy != nil:
+		return req.PendingDeploy.Id
+	case req.ActiveDeploy != nil:
+		return req.ActiveDeploy.Id
+	}
+	return ""
+}
+
+// shareBar draws count's share of total as a bar with a percentage.
+func shareBar(count, total int) string {
+	filled := count * rolloutBarWidth / total
+	return fmt.Sprintf("[%s%s] %3d%%",
+		strings.Repeat("#", filled), strings.Repeat(".", rolloutBarWidth-filled),
+		count*100/total)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// sampleOutput lists, for each request, the distinct values of each
+// environment variable across its tasks with how many tasks have each, so
+// that drift in a request's configuration stands out.
+type sampleOutput struct {
+	writer     tableWriter
+	withHeader bool
+	withURL    bool
+	requests   map[string]*sampledRequest
+}
+
+type sampledRequest struct {
+	url, reqID string
+	values     map[string]map[string]int // variable, value: count
+}
+
+func newSampleOutput(opts *options, w io.Writer) *sampleOutput {
+	return &sampleOutput{
+		writer:   opts.newTabWriter(w),
+		withURL:  opts.multiSingularity(),
+		requests: map[string]*sampledRequest{},
+	}
+}
+
+func (out *sampleOutput) header(opts *options) {
+	out.withHeader = true
+}
+
+func (out *sampleOutput) row(td *taskDesc, opts *options) {
+	key := td.requestKey()
+	req, have := out.requests[key]
+	if !have {
+		req = &sampledRequest{url: td.URL, reqID: td.SingularityTaskId.RequestId, values: map[string]map[string]int{}}
+		out.requests[key] = req
+	}
+	vars := req.values
+	if td.placeholder() {
+		return
+	}
+	for _, pair := range longEnv(td, opts) {
+		if vars[pair[0]] == nil {
+			vars[pair[0]] = map[string]int{}
+		}
+		vars[pair[0]][pair[1]]++
+	}
+}
+
+func (out *sampleOutput) flush() {
+	if out.withHeader {
+		if out.withURL {
+			fmt.Fprint(out.writer, "Singularity\t")
+		}
+		fmt.Fprintln(out.writer, "Request ID\tVariable\tValues")
+	}
+	reqs := []*sampledRequest{}
+	for _, req := range out.requests {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].reqID != reqs[j].reqID {
+			return reqs[i].reqID < reqs[j].reqID
+		}
+		return reqs[i].url < reqs[j].url
+	})
+	for _, req := range reqs {
+		prefix := req.reqID
+		if out.withURL {
+			prefix = req.url + "\t" + req.reqID
+		}
+		vars := req.values
+		if len(vars) == 0 {
+			fmt.Fprintf(out.writer, "%s\tno tasks\t\n", prefix)
+			continue
+		}
+		names := []string{}
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out.writer, "%s\t%s\t%s\n", prefix, name, sampledValues(vars[name]))
+		}
+	}
+	out.writer.Flush()
+}
+
+// sampledValues lists counts' values, most common first, each with its count.
+func sampledValues(counts map[string]int) string {
+	values := []string{}
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+
+	samples := []string{}
+	for _, value := range values {
+		samples = append(samples, fmt.Sprintf("%s(%d)", value, counts[value]))
+	}
+	return strings.Join(samples, ", ")
+}
@@ -0,0 +1,546 @@
+// Package scanner collects the tasks of a Singularity's requests, along with
+// the details of each task that cygnus reports on.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	singularity "github.com/opentable/go-singularity"
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+// The scopes of a scan: the tasks in each request's active history, in its
+// recent inactive history, or both.
+const (
+	ScopeActive   = "active"
+	ScopeInactive = "inactive"
+	ScopeAll      = "all"
+)
+
+type (
+	// Options configures a Scan.
+	Options struct {
+		// URL is the base URL of the Singularity. Records are labelled with it.
+		URL string
+		// Client talks to the Singularity. Without one, Scan uses a default
+		// client for URL. Programs that scan repeatedly should make a Client
+		// once and pass it to every Scan, so that its connections are reused.
+		Client *singularity.Client
+		// Requests are the requests to scan. If nil, every request is scanned.
+		Requests dtos.SingularityRequestParentList
+		// Scope is one of ScopeActive (the default), ScopeInactive or ScopeAll.
+		Scope string
+		// Seen holds the IDs of tasks to skip, because they've already been
+		// scanned. Scan adds the tasks it scans, so that a Seen shared by
+		// several scans reports each task once. NoDedup turns this off.
+		Seen    map[string]struct{}
+		NoDedup bool
+		// Usage fetches resource statistics for running tasks.
+		Usage bool
+		// NoDocker leaves out the docker details of tasks.
+		NoDocker bool
+		// DeployResults fetches the result of each request's latest deploy.
+		DeployResults bool
+		// RequestHistory fetches each request's most recently ended tasks.
+		RequestHistory bool
+		// Limiter, if set, paces the fetches of tasks' details: each waits
+		// on it first. A *rate.Limiter from golang.org/x/time/rate will do.
+		Limiter Limiter
+		// ParallelRequests is how many requests' histories are fetched at
+		// once. Below 1, they are fetched one at a time.
+		ParallelRequests int
+		// Deadline, if set, is when the scan should be over. Requests that
+		// would start after it are skipped, and each request gets a fair
+		// share of the time left as it starts, so that a few big requests
+		// can't starve the rest: what it still has to fetch at the end of
+		// its share, whether waiting on the Limiter or on Singularity, is
+		// skipped. Skips are reported with ErrDeadline.
+		Deadline time.Time
+		// Debug receives a trace of the scan.
+		Debug *log.Logger
+
+		seenLock *sync.Mutex
+	}
+
+	// Limiter paces the work of a scan. Wait blocks until it's the caller's
+	// turn, or fails once ctx is done.
+	Limiter interface {
+		Wait(ctx context.Context) error
+	}
+
+	// TaskRecord is everything a scan learned about one task.
+	TaskRecord struct {
+		*dtos.SingularityTaskId
+		*dtos.SingularityTask
+		*dtos.SingularityRequestParent
+		// The latest update of the task.
+		*dtos.SingularityTaskHistoryUpdate
+		*dtos.DockerInfo
+		URL          string
+		Usage        *dtos.MesosTaskStatisticsObject
+		Healthchecks dtos.SingularityTaskHealthcheckResultList
+		Updates      dtos.SingularityTaskHistoryUpdateList
+		// FetchTime is how long fetching the task's details took.
+		FetchTime time.Duration
+		// DeployResult is the result of the request's latest deploy, if
+		// Options.DeployResults asked for it and there is one.
+		DeployResult *dtos.SingularityDeployResult
+		// RequestHistory is the most recently ended tasks of the request,
+		// if Options.RequestHistory asked for them.
+		RequestHistory dtos.SingularityTaskIdHistoryList
+	}
+
+	// Error is a failure to scan part of a Singularity. Failures to list
+	// the requests have no RequestID, and those of a whole request have no
+	// TaskID.
+	Error struct {
+		URL, RequestID, TaskID string
+		Err                    error
+	}
+)
+
+// ErrDeadline is the Err of an *Error for a request or task skipped because
+// the scan ran out of time.
+var ErrDeadline = errors.New("skipped: out of time before the scan's deadline")
+
+// Unwrap is the underlying failure, such as a *swaggering.ReqError from
+// Singularity.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.TaskID != "":
+		return fmt.Sprintf("task %s of request %s at %s: %v", e.TaskID, e.RequestID, e.URL, e.Err)
+	case e.RequestID != "":
+		return fmt.Sprintf("request %s at %s: %v", e.RequestID, e.URL, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.URL, e.Err)
+}
+
+// Scan fetches the tasks of the requests at opts.URL. Each task is sent on
+// the first channel, and any failures along the way as an *Error on the
+// second. Both channels must be drained; they are closed once the scan is
+// complete or ctx is done.
+func Scan(ctx context.Context, opts Options) (<-chan TaskRecord, <-chan error) {
+	if opts.Client == nil {
+		opts.Client = singularity.NewClient(opts.URL)
+	}
+	if opts.Seen == nil {
+		opts.Seen = map[string]struct{}{}
+	}
+	if opts.Debug == nil {
+		opts.Debug = log.New(ioutil.Discard, "", 0)
+	}
+	if opts.ParallelRequests < 1 {
+		opts.ParallelRequests = 1
+	}
+	opts.seenLock = new(sync.Mutex)
+
+	tasks := make(chan TaskRecord, 20)
+	errs := make(chan error, 20)
+	go func() {
+		wait := new(sync.WaitGroup)
+		scanRequests(ctx, &opts, tasks, errs, wait)
+		wait.Wait()
+		close(tasks)
+		close(errs)
+	}()
+	return tasks, errs
+}
+
+func scanRequests(ctx context.Context, opts *Options, tasks chan<- TaskRecord, errs chan<- error, wait *sync.WaitGroup) {
+	reqList := opts.Requests
+	if reqList == nil {
+		opts.Debug.Printf("Getting all requests from %s", opts.URL)
+		var err error
+		reqList, err = opts.Client.GetRequests()
+		if err != nil {
+			sendErr(ctx, errs, &Error{URL: opts.URL, Err: err})
+			return
+		}
+	}
+	reqList = dedupRequests(opts, reqList)
+	opts.Debug.Printf("reqList count: %d", len(reqList))
+
+	byID := make(map[string]*dtos.SingularityRequestParent, len(reqList))
+	for _, req := range reqList {
+		byID[req.Request.Id] = req
+	}
+
+	// Each request is handed over with the count of those left to scan,
+	// itself included, to work out its share of the time.
+	type queued struct {
+		req  *dtos.SingularityRequestParent
+		left int
+	}
+	reqs := make(chan queued)
+	workers := new(sync.WaitGroup)
+	for i := 0; i < opts.ParallelRequests; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for q := range reqs {
+				deadline, ok := opts.requestDeadline(q.left)
+				if !ok {
+					sendErr(ctx, errs, &Error{URL: opts.URL, RequestID: q.req.Request.Id, Err: ErrDeadline})
+					continue
+				}
+				if deadline.IsZero() {
+					scanRequest(ctx, ctx, opts, q.req, byID, tasks, errs, wait)
+					continue
+				}
+				// Against a deadline, the request's tasks are done before
+				// the next request is taken, so its share is of the time
+				// they leave.
+				reqCtx, cancel := context.WithDeadline(ctx, deadline)
+				reqWait := new(sync.WaitGroup)
+				scanRequest(ctx, reqCtx, opts, q.req, byID, tasks, errs, reqWait)
+				reqWait.Wait()
+				cancel()
+			}
+		}()
+	}
+
+	for n, req := range reqList {
+		if ctx.Err() != nil {
+			break
+		}
+		opts.Debug.Printf("req %d: %#v", n, req)
+		reqs <- queued{req, len(reqList) - n}
+	}
+	close(reqs)
+	workers.Wait()
+}
+
+// requestDeadline is the end of the share of the time to opts.Deadline for
+// a request with left requests still to scan, itself included: the time
+// remaining split evenly between the rounds of ParallelRequests requests
+// left. It is false once the deadline has passed, and the zero time if
+// there is no deadline.
+func (opts *Options) requestDeadline(left int) (time.Time, bool) {
+	if opts.Deadline.IsZero() {
+		return time.Time{}, true
+	}
+	now := time.Now()
+	remaining := opts.Deadline.Sub(now)
+	if remaining <= 0 {
+		return time.Time{}, false
+	}
+	rounds := (left + opts.ParallelRequests - 1) / opts.ParallelRequests
+	return now.Add(remaining / time.Duration(rounds)), true
+}
+
+// scanRequest fetches the task histories of req, starting a fetch of each
+// task found. Whatever is still being fetched once reqCtx, the request's
+// share of the scan's time, is done is skipped.
+func scanRequest(ctx, reqCtx context.Context, opts *Options, req *dtos.SingularityRequestParent, reqs map[string]*dtos.SingularityRequestParent, tasks chan<- TaskRecord, errs chan<- error, wait *sync.WaitGroup) {
+	reqID := req.Request.Id
+	fetch := func(f func()) bool {
+		if within(reqCtx, f) {
+			return true
+		}
+		if ctx.Err() == nil {
+			sendErr(ctx, errs, &Error{URL: opts.URL, RequestID: reqID, Err: ErrDeadline})
+		}
+		return false
+	}
+
+	var deployResult *dtos.SingularityDeployResult
+	if opts.DeployResults && !fetch(func() { deployResult = getDeployResult(opts, reqID) }) {
+		return
+	}
+	var history dtos.SingularityTaskIdHistoryList
+	if opts.RequestHistory && !fetch(func() { history = getRequestHistory(opts, reqID) }) {
+		return
+	}
+	if opts.Scope == ScopeInactive || opts.Scope == ScopeAll {
+		var histo dtos.SingularityTaskIdHistoryList
+		var err error
+		if !fetch(func() { histo, err = opts.Client.GetTaskHistoryForRequest(reqID, 10, 1) }) {
+			return
+		}
+		if err != nil {
+			sendErr(ctx, errs, &Error{URL: opts.URL, RequestID: reqID, Err: err})
+		}
+		getTasks(ctx, reqCtx, opts, histo, reqs, deployResult, history, tasks, errs, wait)
+	}
+
+	if opts.Scope != ScopeInactive {
+		var histo dtos.SingularityTaskIdHistoryList
+		var err error
+		if !fetch(func() { histo, err = opts.Client.GetTaskHistoryForActiveRequest(reqID) }) {
+			return
+		}
+		if err != nil {
+			sendErr(ctx, errs, &Error{URL: opts.URL, RequestID: reqID, Err: err})
+		}
+		getTasks(ctx, reqCtx, opts, histo, reqs, deployResult, history, tasks, errs, wait)
+	}
+}
+
+// within runs fetch, giving up on it once ctx is done, and is false if it
+// did. The Singularity client's calls can't be cancelled, so a fetch given up
+// on runs on in the background and what it fetches is dropped: the caller
+// mustn't look at it.
+func within(ctx context.Context, fetch func()) bool {
+	if ctx.Done() == nil {
+		fetch()
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fetch()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// dedupRequests drops repeats of a request from reqList, so that its
+// histories are fetched once.
+func dedupRequests(opts *Options, reqList dtos.SingularityRequestParentList) dtos.SingularityRequestParentList {
+	ids := map[string]struct{}{}
+	deduped := reqList[:0:0]
+	for _, req := range reqList {
+		if _, dup := ids[req.Request.Id]; dup {
+			opts.Debug.Printf("Dropping duplicate request %s", req.Request.Id)
+			continue
+		}
+		ids[req.Request.Id] = struct{}{}
+		deduped = append(deduped, req)
+	}
+	return deduped
+}
+
+func getTasks(ctx, reqCtx context.Context, opts *Options, histo dtos.SingularityTaskIdHistoryList, reqs map[string]*dtos.SingularityRequestParent, deployResult *dtos.SingularityDeployResult, history dtos.SingularityTaskIdHistoryList, tasks chan<- TaskRecord, errs chan<- error, wait *sync.WaitGroup) {
+	for _, hist := range histo {
+		if !opts.NoDedup && !opts.markSeen(hist.TaskId.Id) {
+			continue
+		}
+
+		wait.Add(1)
+		opts.Debug.Printf("Starting line for %#v", hist.TaskId)
+		go getTask(ctx, reqCtx, opts, hist.TaskId, reqs, deployResult, history, tasks, errs, wait)
+	}
+}
+
+// markSeen records that the task id is being scanned, and is false if it
+// already was.
+func (opts *Options) markSeen(id string) bool {
+	opts.seenLock.Lock()
+	defer opts.seenLock.Unlock()
+	if _, have := opts.Seen[id]; have {
+		return false
+	}
+	opts.Seen[id] = struct{}{}
+	return true
+}
+
+func getTask(ctx, reqCtx context.Context, opts *Options, id *dtos.SingularityTaskId, reqs map[string]*dtos.SingularityRequestParent, deployResult *dtos.SingularityDeployResult, history dtos.SingularityTaskIdHistoryList, tasks chan<- TaskRecord, errs chan<- error, wait *sync.WaitGroup) {
+	defer wait.Done()
+
+	if id == nil {
+		sendErr(ctx, errs, &Error{URL: opts.URL, Err: fmt.Errorf("missing ID for task")})
+		return
+	}
+
+	taskReq := reqs[id.RequestId]
+	cut := func() {
+		if ctx.Err() == nil {
+			sendErr(ctx, errs, &Error{URL: opts.URL, RequestID: id.RequestId, TaskID: id.Id, Err: ErrDeadline})
+		}
+	}
+
+	if opts.Limiter != nil {
+		if err := opts.Limiter.Wait(reqCtx); err != nil {
+			cut()
+			return
+		}
+	}
+
+	var rec TaskRecord
+	var err error
+	if !within(reqCtx, func() { rec, err = fetchTask(opts, id, taskReq, deployResult) }) {
+		cut()
+		return
+	}
+	if err != nil {
+		sendErr(ctx, errs, &Error{URL: opts.URL, RequestID: id.RequestId, TaskID: id.Id, Err: err})
+		return
+	}
+	rec.RequestHistory = history
+
+	select {
+	case tasks <- rec:
+	case <-ctx.Done():
+	}
+}
+
+// Task fetches the task with ID taskID, along with its request, without
+// scanning any others. Failures are reported as an *Error.
+func Task(opts Options, taskID string) (TaskRecord, error) {
+	if opts.Client == nil {
+		opts.Client = singularity.NewClient(opts.URL)
+	}
+	if opts.Debug == nil {
+		opts.Debug = log.New(ioutil.Discard, "", 0)
+	}
+
+	rec, err := fetchTask(&opts, &dtos.SingularityTaskId{Id: taskID}, nil, nil)
+	if err != nil {
+		return rec, &Error{URL: opts.URL, TaskID: taskID, Err: err}
+	}
+
+	reqID := rec.SingularityTaskId.RequestId
+	rec.SingularityRequestParent, err = opts.Client.GetRequest(reqID)
+	if err != nil {
+		opts.Debug.Printf("No request %s for task %s: %v", reqID, taskID, err)
+		rec.SingularityRequestParent = nil
+	}
+	if opts.DeployResults {
+		rec.DeployResult = getDeployResult(&opts, reqID)
+	}
+	if opts.RequestHistory {
+		rec.RequestHistory = getRequestHistory(&opts, reqID)
+	}
+	return rec, nil
+}
+
+// fetchTask fetches the details of the task id, of the request req. The
+// record's task ID is the one Singularity has for the task, which is
+// complete even if id only has the task's Id.
+func fetchTask(opts *Options, id *dtos.SingularityTaskId, req *dtos.SingularityRequestParent, deployResult *dtos.SingularityDeployResult) (TaskRecord, error) {
+	start := time.Now()
+
+	var task *dtos.SingularityTask
+	var err error
+
+	var taskHistory *dtos.SingularityTaskHistory
+	var lastUpdate *dtos.SingularityTaskHistoryUpdate
+	var dockerInfo *dtos.DockerInfo
+
+	for i := 0; i < 3; i++ {
+		opts.Debug.Printf("Getting history: %v of request %s", id.Id, id.RequestId)
+		taskHistory, err = opts.Client.GetHistoryForTask(id.Id)
+		opts.Debug.Printf("taskHistory: %#v", taskHistory)
+
+		if err == nil {
+			task = taskHistory.Task
+			break
+		}
+	}
+	if err != nil {
+		return TaskRecord{}, fmt.Errorf("getting history: %w", err)
+	}
+	if task != nil && task.TaskId != nil {
+		id = task.TaskId
+	}
+
+	// A task may have no updates yet, leaving lastUpdate nil.
+	for _, upd := range taskHistory.TaskUpdates {
+		if lastUpdate == nil || upd.Timestamp > lastUpdate.Timestamp {
+			lastUpdate = upd
+		}
+	}
+	opts.Debug.Printf("last update: %#v", lastUpdate)
+	opts.Debug.Printf("task request: %#v", task)
+
+	if task == nil {
+		return TaskRecord{}, fmt.Errorf("no task in its history: %#v", taskHistory)
+	}
+
+	// The mesos task info may be partial: a task still reports its status
+	// and docker details without a command or its environment, which are
+	// left for the record's consumers to find missing.
+	mesos := task.MesosTask
+	switch {
+	case mesos == nil:
+		opts.Debug.Printf("missing mesos task info: %#v", task)
+	case mesos.Command == nil:
+		opts.Debug.Printf("no command: %#v", mesos)
+	case mesos.Command.Environment == nil:
+		opts.Debug.Printf("no environment: %#v / %#v", mesos, mesos.Command)
+	}
+
+	// Mesos native tasks may have no container, or one without docker info.
+	if mesos != nil && mesos.Container != nil && !opts.NoDocker {
+		opts.Debug.Printf("mesos task info container %#v", mesos.Container)
+		dockerInfo = mesos.Container.Docker
+		opts.Debug.Printf("mesos task info docker %#v", dockerInfo)
+	}
+
+	var usage *dtos.MesosTaskStatisticsObject
+	if opts.Usage && lastUpdate != nil &&
+		lastUpdate.TaskState == dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING {
+		usage = getUsage(opts, id)
+	}
+
+	return TaskRecord{id, task, req, lastUpdate, dockerInfo, opts.URL, usage, taskHistory.HealthcheckResults, taskHistory.TaskUpdates, time.Since(start), deployResult, nil}, nil
+}
+
+// getUsage fetches the resource statistics of a running task. Singularity
+// only has statistics for live tasks, so any failure just means "no data".
+func getUsage(opts *Options, id *dtos.SingularityTaskId) *dtos.MesosTaskStatisticsObject {
+	stats, err := opts.Client.GetTaskStatistics(id.Id)
+	if err != nil {
+		opts.Debug.Printf("No usage statistics for task %s of request %s: %v", id.Id, id.RequestId, err)
+		return nil
+	}
+	return stats
+}
+
+// DeployResult fetches the result of the latest deploy of the request reqID,
+// as Scan does with DeployResults for the requests whose tasks it finds.
+func DeployResult(opts Options, reqID string) *dtos.SingularityDeployResult {
+	return getDeployResult(&opts, reqID)
+}
+
+// requestHistoryCount is how many of a request's ended tasks
+// RequestHistory fetches.
+const requestHistoryCount = 100
+
+// getRequestHistory fetches the most recently ended tasks of a request.
+func getRequestHistory(opts *Options, reqID string) dtos.SingularityTaskIdHistoryList {
+	history, err := opts.Client.GetTaskHistoryForRequest(reqID, requestHistoryCount, 1)
+	if err != nil {
+		opts.Debug.Printf("No task history for request %s: %v", reqID, err)
+		return nil
+	}
+	return history
+}
+
+// getDeployResult fetches the result of the latest deploy of a request. A
+// request without deploy history has none.
+func getDeployResult(opts *Options, reqID string) *dtos.SingularityDeployResult {
+	deploys, err := opts.Client.GetDeploys(reqID, 1, 1)
+	if err != nil {
+		opts.Debug.Printf("No deploy history for request %s: %v", reqID, err)
+		return nil
+	}
+	if len(deploys) == 0 {
+		return nil
+	}
+	return deploys[0].DeployResult
+}
+
+func sendErr(ctx context.Context, errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-ctx.Done():
+	}
+}
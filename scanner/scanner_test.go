@@ -0,0 +1,228 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+// fakeSingularity serves the canned responses under the repository's
+// testdata/singularity, as main's tests do, delaying those whose paths start
+// with slow by a second. Paths without a file get a 404.
+func fakeSingularity(t *testing.T, slow string) *httptest.Server {
+	root := filepath.Join("..", "testdata", "singularity")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow != "" && strings.HasPrefix(r.URL.Path, slow) {
+			time.Sleep(time.Second)
+		}
+		file := filepath.Join(root, filepath.FromSlash(path.Clean(r.URL.Path))+".json")
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// scan runs a Scan with opts, and returns the IDs of the tasks it found,
+// sorted, and the errors it reported.
+func scan(opts Options) ([]string, []*Error) {
+	tasks, errs := Scan(context.Background(), opts)
+	ids := []string{}
+	var errList []*Error
+	for tasks != nil || errs != nil {
+		select {
+		case rec, ok := <-tasks:
+			if !ok {
+				tasks = nil
+				continue
+			}
+			ids = append(ids, rec.SingularityTaskId.Id)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			var serr *Error
+			if !errors.As(err, &serr) {
+				serr = &Error{Err: err}
+			}
+			errList = append(errList, serr)
+		}
+	}
+	sort.Strings(ids)
+	return ids, errList
+}
+
+func named(ids ...string) dtos.SingularityRequestParentList {
+	reqs := dtos.SingularityRequestParentList{}
+	for _, id := range ids {
+		reqs = append(reqs, &dtos.SingularityRequestParent{Request: &dtos.SingularityRequest{Id: id}})
+	}
+	return reqs
+}
+
+func TestScanScopes(t *testing.T) {
+	srv := fakeSingularity(t, "")
+	for _, c := range []struct {
+		scope string
+		want  []string
+	}{
+		{"", []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d2-1"}},
+		{ScopeActive, []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d2-1"}},
+		// The fake's request history, like Singularity's while tasks are
+		// being cleaned up, still lists tasks that are active.
+		{ScopeInactive, []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d1-3", "team-web-d2-1"}},
+		{ScopeAll, []string{"other-svc-o1-1", "team-web-d1-2", "team-web-d1-3", "team-web-d2-1"}},
+	} {
+		got, errs := scan(Options{URL: srv.URL, Scope: c.scope})
+		if len(errs) > 0 {
+			t.Errorf("scope %q: %v", c.scope, errs)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("scope %q scanned %v, want %v", c.scope, got, c.want)
+		}
+	}
+}
+
+func TestScanSeen(t *testing.T) {
+	srv := fakeSingularity(t, "")
+	seen := map[string]struct{}{"team-web-d2-1": {}}
+	got, _ := scan(Options{URL: srv.URL, Seen: seen})
+	if want := []string{"other-svc-o1-1", "team-web-d1-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v past a seen task, want %v", got, want)
+	}
+	if _, have := seen["team-web-d1-2"]; !have {
+		t.Errorf("scanned tasks weren't added to Seen: %v", seen)
+	}
+
+	got, _ = scan(Options{URL: srv.URL, Seen: seen, NoDedup: true})
+	if len(got) != 3 {
+		t.Errorf("scanned %v with NoDedup", got)
+	}
+}
+
+func TestScanReportsErrors(t *testing.T) {
+	srv := fakeSingularity(t, "")
+
+	// A task Singularity has no history for.
+	ids, errs := scan(Options{URL: srv.URL, Requests: named("ghost")})
+	if len(ids) != 0 || len(errs) != 1 {
+		t.Fatalf("got tasks %v and errors %v, want 1 error", ids, errs)
+	}
+	if err := errs[0]; err.URL != srv.URL || err.RequestID != "ghost" || err.TaskID != "ghost-g1-1" {
+		t.Errorf("error names %s, request %q and task %q", err.URL, err.RequestID, err.TaskID)
+	}
+
+	// A Singularity without a request list.
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	ids, errs = scan(Options{URL: down.URL})
+	if len(ids) != 0 || len(errs) != 1 || errs[0].RequestID != "" || errs[0].URL != down.URL {
+		t.Errorf("got tasks %v and errors %v, want one for the request list", ids, errs)
+	}
+}
+
+// stuckLimiter never lets a task through.
+type stuckLimiter struct{}
+
+func (stuckLimiter) Wait(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestScanDeadline(t *testing.T) {
+	srv := fakeSingularity(t, "")
+	scanUntil := func(deadline time.Time) ([]string, []*Error) {
+		return scan(Options{URL: srv.URL, Scope: ScopeAll, Limiter: stuckLimiter{}, Deadline: deadline})
+	}
+
+	// Past the deadline, every request is skipped whole.
+	ids, skipped := scanUntil(time.Now().Add(-time.Second))
+	if len(ids) != 0 || len(skipped) == 0 {
+		t.Errorf("past the deadline, scanned %v and skipped %d", ids, len(skipped))
+	}
+	for _, err := range skipped {
+		if err.Err != ErrDeadline || err.TaskID != "" {
+			t.Errorf("skipped %v of a request that shouldn't have started", err)
+		}
+	}
+
+	// Tasks stuck at the limiter are given up on within the deadline.
+	start := time.Now()
+	ids, skipped = scanUntil(start.Add(200 * time.Millisecond))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scan took %s against a 200ms deadline", elapsed)
+	}
+	if len(ids) != 0 || len(skipped) == 0 {
+		t.Errorf("with a stuck limiter, scanned %v and skipped %d", ids, len(skipped))
+	}
+	for _, err := range skipped {
+		if err.Err != ErrDeadline || err.TaskID == "" {
+			t.Errorf("skipped %v, rather than its tasks", err)
+		}
+	}
+}
+
+func TestScanDeadlineWithoutLimiter(t *testing.T) {
+	for _, c := range []struct {
+		slow   string
+		taskID bool
+	}{
+		{"/api/history/task/team-web-", true},
+		{"/api/history/request/team-web/", false},
+	} {
+		srv := fakeSingularity(t, c.slow)
+
+		// team-web's share of 450ms is 150ms, which its slow fetches
+		// overrun without any Limiter to wait on.
+		start := time.Now()
+		ids, skipped := scan(Options{URL: srv.URL, Scope: ScopeAll, Deadline: start.Add(450 * time.Millisecond)})
+		if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+			t.Errorf("slow %s: scan took %s against a 450ms deadline", c.slow, elapsed)
+		}
+
+		if want := []string{"other-svc-o1-1"}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("slow %s: scanned %v, want %v", c.slow, ids, want)
+		}
+		if len(skipped) == 0 {
+			t.Errorf("slow %s: nothing skipped", c.slow)
+		}
+		for _, err := range skipped {
+			if err.Err != ErrDeadline || err.RequestID != "team-web" || (err.TaskID != "") != c.taskID {
+				t.Errorf("slow %s: skipped %v", c.slow, err)
+			}
+		}
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	if deadline, ok := (&Options{ParallelRequests: 1}).requestDeadline(3); !ok || !deadline.IsZero() {
+		t.Errorf("without a Deadline, a request's is %v, %v", deadline, ok)
+	}
+	if _, ok := (&Options{ParallelRequests: 1, Deadline: time.Now().Add(-time.Second)}).requestDeadline(3); ok {
+		t.Error("past the Deadline, a request was given a share")
+	}
+
+	// Three requests left, two at a time, make two rounds: each gets half.
+	opts := &Options{ParallelRequests: 2, Deadline: time.Now().Add(time.Minute)}
+	deadline, ok := opts.requestDeadline(3)
+	if share := time.Until(deadline); !ok || share > 30*time.Second || share < 29*time.Second {
+		t.Errorf("share of a minute for 3 requests, 2 at a time: %s", share)
+	}
+}
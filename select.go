@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// selectRequests lets the user narrow reqList down interactively.
+// Entering text fuzzy-filters the list, entering numbers picks entries from
+// the shown matches, and an empty line accepts every shown match.
+func selectRequests(reqList dtos.SingularityRequestParentList, in io.Reader, out io.Writer) (dtos.SingularityRequestParentList, error) {
+	scanner := bufio.NewScanner(in)
+	matches := reqList
+
+	for {
+		for n, req := range matches {
+			fmt.Fprintf(out, "%3d) %s\n", n+1, selectorLine(req))
+		}
+		fmt.Fprintf(out, "%d/%d requests - filter, pick numbers, or enter to accept: ", len(matches), len(reqList))
+
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("selection cancelled")
+		}
+		input := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case input == "":
+			return matches, nil
+		case isSelection(input):
+			return pickRequests(matches, input)
+		default:
+			matches = fuzzyFilter(reqList, input)
+		}
+	}
+}
+
+func selectorLine(req *dtos.SingularityRequestParent) string {
+	if req.Request == nil {
+		return fmt.Sprintf("<? unknown ?>\t\t%s", req.State)
+	}
+	return fmt.Sprintf("%s\t%s\t%s", req.Request.Id, req.Request.RequestType, req.State)
+}
+
+func isSelection(input string) bool {
+	for _, r := range input {
+		if !unicode.IsDigit(r) && !unicode.IsSpace(r) && r != ',' {
+			return false
+		}
+	}
+	return true
+}
+
+func pickRequests(matches dtos.SingularityRequestParentList, input string) (dtos.SingularityRequestParentList, error) {
+	picked := dtos.SingularityRequestParentList{}
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > len(matches) {
+			return nil, fmt.Errorf("no such request in selection: %q", field)
+		}
+		picked = append(picked, matches[n-1])
+	}
+	return picked, nil
+}
+
+func fuzzyFilter(reqList dtos.SingularityRequestParentList, query string) dtos.SingularityRequestParentList {
+	matches := dtos.SingularityRequestParentList{}
+	for _, req := range reqList {
+		if fuzzyMatch(strings.ToLower(selectorLine(req)), strings.ToLower(query)) {
+			matches = append(matches, req)
+		}
+	}
+	return matches
+}
+
+// fuzzyMatch reports whether the runes of query appear in line in order.
+func fuzzyMatch(line, query string) bool {
+	rest := line
+	for _, r := range query {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		idx := strings.IndexRune(rest, r)
+		if idx < 0 {
+			return false
+		}
+		rest = rest[idx+len(string(r)):]
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+func TestSelectRequests(t *testing.T) {
+	reqList := dtos.SingularityRequestParentList{}
+	for _, id := range []string{"team-web", "team-batch", "other-svc"} {
+		reqList = append(reqList, &dtos.SingularityRequestParent{
+			Request: &dtos.SingularityRequest{Id: id, RequestType: dtos.SingularityRequestRequestTypeSERVICE},
+			State:   dtos.SingularityRequestParentRequestStateACTIVE,
+		})
+	}
+
+	cases := []struct {
+		input string
+		want  []string // nil for an error
+	}{
+		{"\n", []string{"team-web", "team-batch", "other-svc"}},
+		{"2\n", []string{"team-batch"}},
+		{"3, 1\n", []string{"other-svc", "team-web"}},
+		{"tmwb\n\n", []string{"team-web"}},
+		{"team\n2\n", []string{"team-batch"}},
+		{"team\nother\n\n", []string{"other-svc"}}, // each filter is of the whole list
+		{"team\n3\n", nil},
+		{"0\n", nil},
+		{"4\n", nil},
+		{"", nil},
+		{"team\n", nil},
+	}
+	for _, c := range cases {
+		picked, err := selectRequests(reqList, strings.NewReader(c.input), ioutil.Discard)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%q: picked %d requests, want an error", c.input, len(picked))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.input, err)
+			continue
+		}
+		got := []string{}
+		for _, req := range picked {
+			got = append(got, req.Request.Id)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: picked %v, want %v", c.input, got, c.want)
+		}
+	}
+}
+
+func TestIsSelection(t *testing.T) {
+	for input, want := range map[string]bool{
+		"1":      true,
+		"1, 2 3": true,
+		"":       true,
+		"1a":     false,
+		"web":    false,
+	} {
+		if got := isSelection(input); got != want {
+			t.Errorf("isSelection(%q) is %v, want %v", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nyarly/cygnus/scanner"
+	"github.com/opentable/swaggering"
+)
+
+// detailColumns are the columns "cygnus task" shows of its task, in table
+// format.
+var detailColumns = []string{"task", "req", "deploy", "state", "status", "container", "docker", "agent", "rack", "health", "message", "launch", "cpu", "mem", "result", "stale", "schedule"}
+
+// showTask prints the task with ID taskID, from whichever of the --urls has
+// it, with every detail cygnus knows of.
+func showTask(opts *options, taskID string) {
+	rec := findTask(opts, taskID)
+
+	dest, closeDest, err := openDestination(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	full := opts.full()
+	td := (&taskDesc{rec}).decoded(full).redacted(full)
+	if opts.format == "table" && opts.tmpl == nil {
+		writeTaskDetail(dest, td, full)
+	} else {
+		out := newFormatOutput(full, dest)
+		if opts.printHeaders {
+			out.header(full)
+		}
+		out.row(td, full)
+		out.flush()
+	}
+	if err := closeDest(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// findTask fetches the task with ID taskID from whichever of the --urls has
+// it, exiting if none do.
+func findTask(opts *options, taskID string) scanner.TaskRecord {
+	for _, url := range opts.url {
+		client, err := newClient(opts, url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rec, err := scanner.Task(scanner.Options{
+			URL:            url,
+			Client:         client,
+			Usage:          true,
+			DeployResults:  true,
+			RequestHistory: true,
+			NoDocker:       opts.noDocker,
+			Debug:          debugLog,
+		}, taskID)
+		var rerr *swaggering.ReqError
+		if errors.As(err, &rerr) && rerr.Status == http.StatusNotFound {
+			debug("No task %s at %s", taskID, url)
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return rec
+	}
+	log.Fatalf("No task %s at %s", taskID, strings.Join(opts.url, ", "))
+	return scanner.TaskRecord{}
+}
+
+// writeTaskDetail writes td as a list of its columns, followed by its
+// environment and its updates.
+func writeTaskDetail(w io.Writer, td *taskDesc, opts *options) {
+	tw := opts.newTabWriter(w)
+	for _, name := range detailColumns {
+		if name == "docker" && opts.noDocker {
+			continue
+		}
+		col := columnProducers[name]
+		fmt.Fprintf(tw, "%s:\t%s\n", col.header, columnValue(col, td, opts))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nEnvironment:")
+	for _, pair := range longEnv(td, opts) {
+		fmt.Fprintf(tw, "  %s\t%s\n", pair[0], pair[1])
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nUpdates:")
+	for _, upd := range td.updates() {
+		state := upd.State
+		if opts.shortStates {
+			state = shortState(state)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", upd.Time.Format("2006-01-02T15:04:05Z07:00"), state, strings.Join(strings.Fields(upd.Message), " "))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nyarly/cygnus/scanner"
+	"github.com/opentable/swaggering"
+)
+
+func TestTaskDetail(t *testing.T) {
+	client, url := fakeClient(t, &options{})
+	rec, err := scanner.Task(scanner.Options{URL: url, Client: client}, "team-web-d2-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := &taskDesc{rec}
+	if td.SingularityTaskId.RequestId != "team-web" || td.deployState() != "active" {
+		t.Errorf("task of request %q, deploy state %q", td.SingularityTaskId.RequestId, td.deployState())
+	}
+
+	buf := &bytes.Buffer{}
+	writeTaskDetail(buf, td, (&options{}).full())
+	for _, want := range []string{"Task ID:        team-web-d2-1", "PORT0", "TASK_RUNNING"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("detail lacks %q:\n%s", want, buf)
+		}
+	}
+}
+
+func TestTaskNotFound(t *testing.T) {
+	client, url := fakeClient(t, &options{})
+	_, err := scanner.Task(scanner.Options{URL: url, Client: client}, "no-such-task")
+	var rerr *swaggering.ReqError
+	if !errors.As(err, &rerr) || rerr.Status != http.StatusNotFound {
+		t.Errorf("got %v, want a 404", err)
+	}
+}
+
+func TestCompareEnvs(t *testing.T) {
+	buf := &bytes.Buffer{}
+	compareEnvs(buf, "a", "b",
+		map[string]string{"SAME": "1", "GONE": "x", "CHANGED": "old"},
+		map[string]string{"SAME": "1", "NEW": "y", "CHANGED": "new"},
+		false)
+
+	want := "--- a\n+++ b\n" +
+		"-CHANGED=old\n+CHANGED=new\n" +
+		"-GONE=x\n" +
+		"+NEW=y\n"
+	if got := buf.String(); got != want {
+		t.Errorf("comparison:\n%s\nwant:\n%s", got, want)
+	}
+}
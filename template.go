@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"text/template"
+)
+
+// parseTemplate reads the template given by --template or --template-file.
+// It returns nil when neither was given.
+func parseTemplate(opts *options) (*template.Template, error) {
+	switch {
+	case opts.template != "" && opts.templateFile != "":
+		return nil, fmt.Errorf("--template and --template-file can't be used together")
+	case opts.template != "":
+		return template.New("--template").Parse(opts.template)
+	case opts.templateFile != "":
+		text, err := ioutil.ReadFile(opts.templateFile)
+		if err != nil {
+			return nil, err
+		}
+		// Naming the template for the file puts its path and the line
+		// number in any parse errors.
+		return template.New(opts.templateFile).Parse(string(text))
+	}
+	return nil, nil
+}
+
+// templateOutput executes the template for each task, followed by a newline.
+// The template's data is the task's TaskRecord, with every field filled in.
+type templateOutput struct {
+	w    io.Writer
+	tmpl *template.Template
+}
+
+func (out *templateOutput) header(opts *options) {}
+
+func (out *templateOutput) row(td *taskDesc, opts *options) {
+	if err := out.tmpl.Execute(out.w, td.toRecord(opts.full())); err != nil {
+		log.Print(err)
+		return
+	}
+	io.WriteString(out.w, "\n")
+}
+
+func (out *templateOutput) flush() {}
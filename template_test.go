@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.tmpl")
+	text := `{{.TaskID}} {{.Status}} {{index .Env "TASK_HOST"}}`
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, tasks := scanFake(t, "--template-file="+path)
+	buf := &bytes.Buffer{}
+	out := newOutput(opts, buf)
+	for _, td := range tasks {
+		out.row(td, opts)
+	}
+	out.flush()
+
+	want := "" +
+		"other-svc-o1-1 TASK_RUNNING host1\n" +
+		"team-web-d1-2 TASK_RUNNING host2\n" +
+		"team-web-d2-1 TASK_RUNNING host1\n"
+	if got := buf.String(); got != want {
+		t.Errorf("template output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTemplateFileParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.tmpl")
+	if err := ioutil.WriteFile(path, []byte("ok\n{{.TaskID}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := parseTemplate(&options{templateFile: path})
+	if err == nil {
+		t.Fatal("expected a parse error")
+	}
+	if !strings.Contains(err.Error(), path+":2") {
+		t.Errorf("error %q doesn't name the file and line", err)
+	}
+}
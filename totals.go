@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+// totalsOutput sums the resources allocated to each request's running
+// tasks, for capacity planning. Requests are listed heaviest on memory first.
+type totalsOutput struct {
+	writer     tableWriter
+	withHeader bool
+	withURL    bool
+	requests   map[string]*requestTotals
+}
+
+type requestTotals struct {
+	url, reqID   string
+	tasks        int
+	cpus, memMb  float64
+	memUsedBytes int64
+}
+
+func newTotalsOutput(opts *options, w io.Writer) *totalsOutput {
+	return &totalsOutput{
+		writer:   opts.newTabWriter(w),
+		withURL:  opts.multiSingularity(),
+		requests: map[string]*requestTotals{},
+	}
+}
+
+func (out *totalsOutput) header(opts *options) {
+	out.withHeader = true
+}
+
+func (out *totalsOutput) row(td *taskDesc, opts *options) {
+	key := td.requestKey()
+	totals, have := out.requests[key]
+	if !have {
+		totals = &requestTotals{url: td.URL, reqID: td.SingularityTaskId.RequestId}
+		out.requests[key] = totals
+	}
+	if td.placeholder() || td.status() != string(dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING) {
+		return
+	}
+	cpus, memMb := td.allocation()
+	totals.tasks++
+	totals.cpus += cpus
+	totals.memMb += memMb
+	if td.Usage != nil {
+		totals.memUsedBytes += td.Usage.MemRssBytes
+	}
+}
+
+func (out *totalsOutput) flush() {
+	if out.withHeader {
+		if out.withURL {
+			fmt.Fprint(out.writer, "Singularity\t")
+		}
+		fmt.Fprintln(out.writer, "Request ID\tRunning\tCPUs\tMemory\tMem Used")
+	}
+
+	totals := []*requestTotals{}
+	for _, t := range out.requests {
+		totals = append(totals, t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].memMb != totals[j].memMb {
+			return totals[i].memMb > totals[j].memMb
+		}
+		if totals[i].reqID != totals[j].reqID {
+			return totals[i].reqID < totals[j].reqID
+		}
+		return totals[i].url < totals[j].url
+	})
+
+	for _, t := range totals {
+		used := ""
+		if t.memUsedBytes > 0 {
+			used = fmt.Sprintf("%.0fMiB", float64(t.memUsedBytes)/mebibyte)
+		}
+		if out.withURL {
+			fmt.Fprintf(out.writer, "%s\t", t.url)
+		}
+		fmt.Fprintf(out.writer, "%s\t%d\t%g\t%.0fMiB\t%s\n", t.reqID, t.tasks, t.cpus, t.memMb, used)
+	}
+	out.writer.Flush()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	dtos "github.com/opentable/go-singularity/dtos"
+)
+
+const mebibyte = 1024 * 1024
+
+// allocation returns the cpus and memory (in MiB) the task's deploy asked
+// for, falling back to the limits reported in its statistics.
+func (td *taskDesc) allocation() (cpus, memMb float64) {
+	if tr := td.SingularityTask.TaskRequest; tr != nil && tr.Deploy != nil && tr.Deploy.Resources != nil {
+		return tr.Deploy.Resources.Cpus, tr.Deploy.Resources.MemoryMb
+	}
+	if td.Usage != nil {
+		return float64(td.Usage.CpusLimit), float64(td.Usage.MemLimitBytes) / mebibyte
+	}
+	return 0, 0
+}
+
+// cpuUsed is how many CPUs the task has kept busy, on average, since it
+// started running: the CPU time in its statistics over its uptime when they
+// were taken. It is false without statistics, or a start to measure from.
+func (td *taskDesc) cpuUsed() (float64, bool) {
+	if td.Usage == nil {
+		return 0, false
+	}
+	var started int64
+	for _, upd := range td.Updates {
+		if upd.TaskState == dtos.SingularityTaskHistoryUpdateExtendedTaskStateTASK_RUNNING && (started == 0 || upd.Timestamp < started) {
+			started = upd.Timestamp
+		}
+	}
+	if started == 0 && td.SingularityTaskId != nil {
+		started = td.SingularityTaskId.StartedAt
+	}
+	if started == 0 {
+		return 0, false
+	}
+
+	at := nowFunc()
+	if td.Usage.Timestamp > 0 {
+		at = time.Unix(0, int64(td.Usage.Timestamp*float64(time.Second)))
+	}
+	uptime := at.Sub(time.Unix(0, started*int64(time.Millisecond))).Seconds()
+	if uptime <= 0 {
+		return 0, false
+	}
+	return (td.Usage.CpusUserTimeSecs + td.Usage.CpusSystemTimeSecs) / uptime, true
+}
+
+func (td *taskDesc) cpuUsage() string {
+	if td.Usage == nil {
+		return ""
+	}
+	cpus, _ := td.allocation()
+	used, ok := td.cpuUsed()
+	if !ok {
+		return fmt.Sprintf("?/%g", cpus)
+	}
+	return fmt.Sprintf("%.2f/%g", used, cpus)
+}
+
+func (td *taskDesc) memUsage() string {
+	if td.Usage == nil {
+		return ""
+	}
+	_, memMb := td.allocation()
+	return fmt.Sprintf("%.0fMiB/%.0fMiB", float64(td.Usage.MemRssBytes)/mebibyte, memMb)
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// These are set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("cygnus %s (commit %s, built %s)", version, commit, date)
+}
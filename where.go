@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// wherePredicate is a parsed --where expression: a column, compared to a
+// value with "=" or "!=", or matched against a regular expression with "~".
+type wherePredicate struct {
+	expr  string
+	col   column
+	match func(value string) bool
+}
+
+func parseWhere(expr string, opts *options) (wherePredicate, error) {
+	i := strings.IndexAny(expr, "!=~")
+	if i <= 0 {
+		return wherePredicate{}, fmt.Errorf("invalid --where %q: expected COLUMN=VALUE, COLUMN!=VALUE or COLUMN~REGEXP", expr)
+	}
+
+	name, op, operand := expr[:i], expr[i:i+1], expr[i+1:]
+	if op == "!" {
+		if !strings.HasPrefix(operand, "=") {
+			return wherePredicate{}, fmt.Errorf("invalid --where %q: expected != after %q", expr, name)
+		}
+		op, operand = "!=", operand[1:]
+	}
+
+	col, err := lookupColumn(strings.TrimSpace(name), opts)
+	if err != nil {
+		return wherePredicate{}, fmt.Errorf("invalid --where %q: %v", expr, err)
+	}
+
+	pred := wherePredicate{expr: expr, col: col}
+	switch op {
+	case "=":
+		pred.match = func(value string) bool { return value == operand }
+	case "!=":
+		pred.match = func(value string) bool { return value != operand }
+	case "~":
+		re, err := regexp.Compile(operand)
+		if err != nil {
+			return wherePredicate{}, fmt.Errorf("invalid --where %q: %v", expr, err)
+		}
+		pred.match = re.MatchString
+	}
+	return pred, nil
+}
+
+// whereMatches reports whether td satisfies every --where expression.
+func whereMatches(td *taskDesc, opts *options) bool {
+	for _, pred := range opts.wherePredicates {
+		if !pred.match(pred.col.value(td)) {
+			debug("Skipping %s: doesn't match --where %s", td.SingularityTaskId.Id, pred.expr)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWhere(t *testing.T) {
+	cases := []struct {
+		where []string
+		want  []string
+	}{
+		{[]string{"status=TASK_FAILED"}, []string{"team-web-d1-3"}},
+		{[]string{"req=team-web", "deploy!=d1"}, []string{"team-web-d2-1"}},
+		{[]string{"env:PORT0~^3100[12]$", "req!=other-svc"}, []string{"team-web-d1-2", "team-web-d2-1"}},
+	}
+	for _, c := range cases {
+		args := []string{"--scope=all"}
+		for _, w := range c.where {
+			args = append(args, "--where="+w)
+		}
+		opts, tasks := scanFake(t, args...)
+
+		printed := []*taskDesc{}
+		for _, td := range tasks {
+			if printable(td, opts) {
+				printed = append(printed, td)
+			}
+		}
+		if got := taskIDs(printed); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("--where %v printed %v, want %v", c.where, got, c.want)
+		}
+	}
+}
+
+func TestParseWhereErrors(t *testing.T) {
+	for _, expr := range []string{"status", "=x", "status!x", "bogus=1", "status~("} {
+		if _, err := parseWhere(expr, &options{}); err == nil {
+			t.Errorf("parseWhere(%q) succeeded, want an error", expr)
+		}
+	}
+}